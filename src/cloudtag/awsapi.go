@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// V4 signed call to AWS API that goamz does not cover
+func awsCall(auth aws.Auth, region aws.Region, service string, method string, url string, contentType string, body string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return awsSend(auth, region, service, req)
+}
+
+// Signs and sends the request, the reply body is returned on 2xx only
+func awsSend(auth aws.Auth, region aws.Region, service string, req *http.Request) ([]byte, error) {
+	aws.NewV4Signer(auth, service, region).Sign(req)
+	slog.Debug("sending", "method", req.Method, "url", req.URL.Redacted())
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if service == "sts" {
+		// AssumeRole reply carries the temporary credentials
+		slog.Debug("got", "status", res.Status)
+	} else {
+		slog.Debug("got", "status", res.Status, "body", string(bin))
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, errors.New(fmt.Sprintf("%s %s failed with %v: %s", req.Method, req.URL, res.Status, bin))
+	}
+	return bin, nil
+}
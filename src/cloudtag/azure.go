@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	azureMetadataUrl = "http://169.254.169.254/metadata/"
+	azureManagement  = "https://management.azure.com/"
+)
+
+// Azure virtual machine, tags are set through Resource Manager tags API
+type azureCloud struct {
+	resourceId string
+}
+
+type AzureInstance struct {
+	Compute struct {
+		Name       string `json:"name"`
+		Location   string `json:"location"`
+		Zone       string `json:"zone"`
+		ResourceId string `json:"resourceId"`
+	} `json:"compute"`
+}
+
+func (c *azureCloud) Identity() (instance string, zone string, region string, err error) {
+	var vm AzureInstance
+	err = azureMetadata("instance?api-version=2021-02-01", &vm)
+	if err != nil {
+		return
+	}
+	if vm.Compute.ResourceId == "" {
+		err = errors.New("Azure instance metadata has no compute resourceId")
+		return
+	}
+	c.resourceId = vm.Compute.ResourceId
+	region = vm.Compute.Location
+	zone = region
+	if vm.Compute.Zone != "" {
+		zone = region + "-" + vm.Compute.Zone
+	}
+	return vm.Compute.Name, zone, region, nil
+}
+
+type AzureTagsPatch struct {
+	Operation  string `json:"operation"`
+	Properties struct {
+		Tags map[string]string `json:"tags"`
+	} `json:"properties"`
+}
+
+func (c *azureCloud) Tag(m *Machine) error {
+	return c.patchTags("Merge", m)
+}
+
+// Delete operation removes only the tags with matching values
+func (c *azureCloud) Untag(m *Machine) error {
+	return c.patchTags("Delete", m)
+}
+
+func (c *azureCloud) patchTags(operation string, m *Machine) error {
+	patch := &AzureTagsPatch{Operation: operation}
+	patch.Properties.Tags = make(map[string]string)
+	tags, err := instanceTags(m)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		patch.Properties.Tags[tag.Key] = tag.Value
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = azureMetadata("identity/oauth2/token?api-version=2018-02-01&resource="+url.QueryEscape(azureManagement), &token)
+	if err != nil {
+		return err
+	}
+	location := azureManagement + strings.TrimPrefix(c.resourceId, "/") + "/providers/Microsoft.Resources/tags/default?api-version=2021-04-01"
+	req, err := http.NewRequestWithContext(ctx, "PATCH", location, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	slog.Debug("sending", "method", "PATCH", "url", location, "body", string(body))
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	reply, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	slog.Debug("got", "status", res.Status, "body", string(reply))
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("PATCH %s failed with %v: %s", location, res.Status, reply))
+	}
+	return nil
+}
+
+func azureMetadata(what string, response interface{}) error {
+	value, err := metadataRetry(what, azureMetadataOnce)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), response)
+}
+
+// The metadata service at -metadata-url, azureMetadataUrl by default; the token reply is not logged
+func azureMetadataOnce(what string) (value string, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataUrl+what, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Metadata", "true")
+	res, err := metadataClient.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", true, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, errors.New(fmt.Sprintf("Cannot read Azure instance metadata %v, got %v", what, res.Status))
+	}
+	return string(bin), false, nil
+}
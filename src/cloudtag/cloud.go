@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/ec2"
+	r53 "github.com/mitchellh/goamz/route53"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Cloud specific instance identity and tagging, ETCD index allocation is the same for all clouds
+type Cloud interface {
+	// instance id or name, availability zone, and region
+	Identity() (instance string, zone string, region string, err error)
+	// sets instanceTags(m)
+	Tag(m *Machine) error
+	// removes instanceTags(m) where the value is still the one we set
+	Untag(m *Machine) error
+}
+
+type awsCloud struct {
+	ec2c *ec2.EC2 // set once the region is known
+}
+
+// eipalloc-1a2b3c4d, vol-0123456789abcdef0, and the like
+var awsResourceId = regexp.MustCompile(`^[a-z]+-[0-9a-f]{8}([0-9a-f]{9})?$`)
+
+// Region prefix of availability zone, Local Zone, or Wavelength Zone name:
+// us-east-1a, us-gov-west-1b, us-east-1-bos-1a, us-east-1-wl1-bos-wlz-1
+var zoneRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+`)
+
+func zoneRegion(zone string) string {
+	if region := zoneRegionPattern.FindString(zone); region != "" {
+		return region
+	}
+	return zone[0 : len(zone)-1]
+}
+
+// -region or the instance region, for the index stores that are used before the instance identity is read
+func storeRegion() (string, error) {
+	if regionOverride != "" {
+		return regionOverride, nil
+	}
+	zone, err := metadata("placement/availability-zone")
+	if err != nil {
+		return "", err
+	}
+	return zoneRegion(zone), nil
+}
+
+// The instance and -also-tag-resource ids
+func taggedResources(m *Machine) []string {
+	return append([]string{m.Instance}, alsoTagResources...)
+}
+
+// EC2 and Route53 clients with the instance credentials or the assumed roles, expires is when the first
+// of them expires, zero for static credentials
+func awsClients(region string) (r53c *r53.Route53, ec2c *ec2.EC2, expires time.Time, err error) {
+	auth, expires, err := awsCredentials()
+	if err != nil {
+		return
+	}
+	ec2Auth := auth
+	if assumeRoleArn != "" {
+		var roleExpires time.Time
+		ec2Auth, roleExpires, err = assumeRole(auth, assumeRoleArn)
+		if err != nil {
+			return
+		}
+		if expires.IsZero() || roleExpires.Before(expires) {
+			expires = roleExpires
+		}
+	}
+	dnsAuth := ec2Auth
+	if dnsAssumeRoleArn != "" {
+		var dnsExpires time.Time
+		dnsAuth, dnsExpires, err = assumeRole(auth, dnsAssumeRoleArn)
+		if err != nil {
+			return
+		}
+		if expires.IsZero() || dnsExpires.Before(expires) {
+			expires = dnsExpires
+		}
+	}
+	_region := aws.Regions[region]
+	if awsEndpoint != "" {
+		_region.EC2Endpoint = awsEndpoint
+		_region.Route53Endpoint = awsEndpoint
+	}
+	return r53.New(dnsAuth, _region), ec2.New(ec2Auth, _region), expires, nil
+}
+
+// Instance or environment credentials, without -assume-role
+func awsAuth() (auth aws.Auth, err error) {
+	auth, _, err = awsCredentials()
+	return
+}
+
+// Credentials from the environment, ~/.aws/credentials, or the instance IAM role, in that order;
+// expires is zero unless they are the instance role ones
+func awsCredentials() (auth aws.Auth, expires time.Time, err error) {
+	auth, err = aws.EnvAuth()
+	if err == nil {
+		// temporary credentials from the environment, goamz only picks up the keys
+		if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" && auth.Token == "" {
+			auth.Token = token
+			if expiration, err := time.Parse(time.RFC3339, os.Getenv("AWS_CREDENTIAL_EXPIRATION")); err == nil && time.Now().After(expiration) {
+				slog.Warn("AWS session credentials from environment have expired", "expiration", expiration)
+			}
+		}
+		return
+	}
+	auth, err = aws.SharedAuth()
+	if err == nil {
+		return
+	}
+	return instanceRoleAuth()
+}
+
+type roleCredentials struct {
+	Code            string
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// Instance IAM role credentials, read through metadata() so that IMDSv2 token is sent; goamz reads them with IMDSv1
+func instanceRoleAuth() (auth aws.Auth, expires time.Time, err error) {
+	roles, err := metadata("iam/security-credentials/")
+	if err != nil {
+		return auth, expires, fmt.Errorf("No AWS credentials in environment, ~/.aws/credentials, or instance IAM role: %w", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	value, err := metadata("iam/security-credentials/" + role)
+	if err != nil {
+		return
+	}
+	var creds roleCredentials
+	err = json.Unmarshal([]byte(value), &creds)
+	if err != nil {
+		return auth, expires, errors.New(fmt.Sprintf("Cannot parse credentials of instance IAM role %s: %v", role, err))
+	}
+	if creds.Code != "Success" {
+		return auth, expires, errors.New(fmt.Sprintf("Cannot obtain credentials of instance IAM role %s, got %s", role, creds.Code))
+	}
+	return aws.Auth{AccessKey: creds.AccessKeyId, SecretKey: creds.SecretAccessKey, Token: creds.Token}, creds.Expiration, nil
+}
+
+type IdentityDocument struct {
+	InstanceId       string `json:"instanceId"`
+	AvailabilityZone string `json:"availabilityZone"`
+	Region           string `json:"region"`
+}
+
+func (c *awsCloud) Identity() (instance string, zone string, region string, err error) {
+	if identityDoc {
+		instance, zone, region, err = c.identityDocument()
+		if err == nil {
+			return
+		}
+		slog.Warn("Cannot read instance identity document, falling back to instance metadata", "error", err)
+	}
+	instance = instanceIdOverride
+	if instance == "" {
+		instance, err = metadata("instance-id")
+		if err != nil {
+			return
+		}
+	}
+	if regionOverride != "" {
+		return instance, "", regionOverride, nil
+	}
+	zone, err = metadata("placement/availability-zone")
+	if err != nil {
+		return
+	}
+	region = zoneRegion(zone)
+	return
+}
+
+func (c *awsCloud) Tag(m *Machine) error {
+	tags, err := instanceTags(m)
+	if err != nil {
+		return err
+	}
+	return awsRetry(func() error {
+		_, err := c.ec2c.CreateTags(taggedResources(m), tags)
+		return err
+	})
+}
+
+func (c *awsCloud) Untag(m *Machine) error {
+	tags, err := instanceTags(m)
+	if err != nil {
+		return err
+	}
+	return awsRetry(func() error {
+		_, err := c.ec2c.DeleteTags(taggedResources(m), tags)
+		return err
+	})
+}
+
+// Sets the Name tag on the volumes attached to the instance, rendered with -volume-tag-template
+func (c *awsCloud) TagVolumes(m *Machine) error {
+	filter := ec2.NewFilter()
+	filter.Add("attachment.instance-id", m.Instance)
+	var res *ec2.VolumesResp
+	err := awsRetry(func() (err error) {
+		res, err = c.ec2c.Volumes(nil, filter)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if len(res.Volumes) == 0 {
+		slog.Debug("no volumes attached to the instance", "instance", m.Instance)
+		return nil
+	}
+	var volumes []string
+	for _, volume := range res.Volumes {
+		volumes = append(volumes, volume.VolumeId)
+	}
+	value, err := renderName(volumeTmpl, m)
+	if err != nil {
+		return err
+	}
+	tags := []ec2.Tag{ec2.Tag{Key: tagName, Value: value}}
+	slog.Debug("tagging volumes", "volumes", volumes, "tag", tagName, "value", tags[0].Value)
+	return awsRetry(func() error {
+		_, err := c.ec2c.CreateTags(volumes, tags)
+		return err
+	})
+}
+
+// Sets the instance tags on the primary network interface, device index 0, or on all attached interfaces
+func (c *awsCloud) TagEnis(m *Machine, all bool) error {
+	var res *ec2.InstancesResp
+	err := awsRetry(func() (err error) {
+		res, err = c.ec2c.Instances([]string{m.Instance}, nil)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	var enis []string
+	for _, reservation := range res.Reservations {
+		for _, instance := range reservation.Instances {
+			for _, eni := range instance.NetworkInterfaces {
+				if all || eni.Attachment.DeviceIndex == 0 {
+					enis = append(enis, eni.Id)
+				}
+			}
+		}
+	}
+	if len(enis) == 0 {
+		slog.Warn("No network interfaces found to tag", "instance", m.Instance)
+		return nil
+	}
+	tags, err := instanceTags(m)
+	if err != nil {
+		return err
+	}
+	slog.Debug("tagging network interfaces", "enis", enis)
+	return awsRetry(func() error {
+		_, err := c.ec2c.CreateTags(enis, tags)
+		return err
+	})
+}
+
+// Reads the Name tag back, re-tagging until it holds our value or verifyTagWindow elapses;
+// eventual consistency or CloudFormation may hide or reset the tag right after it is set
+func (c *awsCloud) VerifyTag(m *Machine) error {
+	expected, err := tagValue(m)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	for {
+		var res *ec2.InstancesResp
+		err := awsRetry(func() (err error) {
+			res, err = c.ec2c.Instances([]string{m.Instance}, nil)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		actual := ""
+		for _, reservation := range res.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, tag := range instance.Tags {
+					if tag.Key == tagName {
+						actual = tag.Value
+					}
+				}
+			}
+		}
+		if actual == expected {
+			slog.Debug("verified instance tag", "tag", tagName, "value", actual, "waited", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if time.Since(start) > verifyTagWindow {
+			slog.Warn("Instance tag does not hold our value", "tag", tagName, "expected", expected, "actual", actual, "waited", verifyTagWindow)
+			return nil
+		}
+		slog.Debug("instance tag does not hold our value yet, re-tagging", "tag", tagName, "expected", expected, "actual", actual)
+		err = sleep(verifyTagPause)
+		if err != nil {
+			return err
+		}
+		err = c.Tag(m)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// One request instead of three, the region is given as is instead of being cut from the zone
+func (c *awsCloud) identityDocument() (instance string, zone string, region string, err error) {
+	value, err := metadata("../dynamic/instance-identity/document")
+	if err != nil {
+		return
+	}
+	var doc IdentityDocument
+	err = json.Unmarshal([]byte(value), &doc)
+	if err != nil {
+		return
+	}
+	if doc.InstanceId == "" || doc.Region == "" || doc.AvailabilityZone == "" {
+		return "", "", "", errors.New(fmt.Sprintf("Incomplete instance identity document %s", value))
+	}
+	instance, zone, region = doc.InstanceId, doc.AvailabilityZone, doc.Region
+	if instanceIdOverride != "" {
+		instance = instanceIdOverride
+	}
+	if regionOverride != "" {
+		return instance, "", regionOverride, nil
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestZoneRegion(t *testing.T) {
+	for zone, region := range map[string]string{
+		"us-east-1a":                   "us-east-1",
+		"eu-central-2c":                "eu-central-2",
+		"ap-southeast-4b":              "ap-southeast-4",
+		"us-gov-west-1b":               "us-gov-west-1",
+		"us-east-1-bos-1a":             "us-east-1",
+		"us-west-2-lax-1b":             "us-west-2",
+		"us-east-1-wl1-bos-wlz-1":      "us-east-1",
+		"ap-northeast-1-wl1-nrt-wlz-1": "ap-northeast-1",
+	} {
+		if got := zoneRegion(zone); got != region {
+			t.Errorf("%s: expected region %s, got %s", zone, region, got)
+		}
+	}
+}
+
+// The identity document names the region, nothing is cut from the zone
+func TestIdentityDocumentRegion(t *testing.T) {
+	server := newFakeImds(map[string]string{
+		"/latest/dynamic/instance-identity/document": `{"instanceId": "i-0123456789abcdef0", "availabilityZone": "us-east-1-wl1-bos-wlz-1", "region": "us-east-1"}`,
+	})
+	defer server.Close()
+	useMetadata(server.URL)
+	identityDoc = true
+
+	instance, zone, region, err := (&awsCloud{}).Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance != "i-0123456789abcdef0" || zone != "us-east-1-wl1-bos-wlz-1" || region != "us-east-1" {
+		t.Errorf("unexpected identity %s in %s of %s", instance, zone, region)
+	}
+}
+
+// -index-tag-name is for tooling that sorts and parses it, -index-width pads only the names
+func TestIndexTagNotPadded(t *testing.T) {
+	defer func(name, index string, width int) { tagName, indexTagName, indexWidth = name, index, width }(tagName, indexTagName, indexWidth)
+	tagName, indexTagName, indexWidth = "", "Index", 3
+	tags, err := instanceTags(&Machine{Index: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Key != "Index" || tags[0].Value != "7" {
+		t.Errorf("expected Index=7, got %+v", tags)
+	}
+}
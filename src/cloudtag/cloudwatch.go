@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/mitchellh/goamz/aws"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Publishes IndexAllocated count and AllocationTime since start in CloudTag namespace, with InstanceId dimension
+func putMetrics(m *Machine, elapsed time.Duration) error {
+	auth, err := awsAuth()
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("Action", "PutMetricData")
+	params.Set("Version", "2010-08-01")
+	params.Set("Namespace", "CloudTag")
+	metrics := []struct {
+		name  string
+		value float64
+		unit  string
+	}{
+		{"IndexAllocated", 1, "Count"},
+		{"AllocationTime", float64(elapsed.Milliseconds()), "Milliseconds"},
+	}
+	for i, metric := range metrics {
+		member := "MetricData.member." + strconv.Itoa(i+1) + "."
+		params.Set(member+"MetricName", metric.name)
+		params.Set(member+"Value", strconv.FormatFloat(metric.value, 'f', -1, 64))
+		params.Set(member+"Unit", metric.unit)
+		params.Set(member+"Dimensions.member.1.Name", "InstanceId")
+		params.Set(member+"Dimensions.member.1.Value", m.Instance)
+	}
+	endpoint := "https://monitoring." + m.Region + ".amazonaws.com/"
+	if awsEndpoint != "" {
+		endpoint = awsEndpoint + "/"
+	}
+	return awsRetry(func() error {
+		_, err := awsCall(auth, aws.Region{Name: m.Region}, "monitoring", "POST", endpoint, "application/x-www-form-urlencoded", params.Encode())
+		return err
+	})
+}
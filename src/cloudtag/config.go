@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Applies a config file whose keys mirror the flags, either YAML-style `key: value`
+// or TOML-style `key = value` lines; `#` starts a comment. A list value may be given
+// as [a, b] or by repeating the key. Flags set on the command line take precedence.
+func loadConfig(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return applyConfig(path, file)
+}
+
+// Flags set on the command line or by a config applied before are kept
+func applyConfig(path string, config io.Reader) (err error) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	scanner := bufio.NewScanner(config)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		sep := strings.IndexAny(text, ":=")
+		if sep < 0 {
+			return errors.New(fmt.Sprintf("%s:%d: expected `key: value` or `key = value`, got `%s`", path, line, text))
+		}
+		key := strings.TrimSpace(text[:sep])
+		value := strings.TrimSpace(text[sep+1:])
+		if key == "config" || flag.Lookup(key) == nil {
+			return errors.New(fmt.Sprintf("%s:%d: unknown key `%s`", path, line, key))
+		}
+		if explicit[key] {
+			continue
+		}
+		for _, v := range configValues(value) {
+			err = flag.Set(key, v)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s:%d: bad value for `%s`: %v", path, line, key, err))
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func configValues(value string) []string {
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		var values []string
+		for _, v := range strings.Split(value[1:len(value)-1], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, unquote(v))
+			}
+		}
+		return values
+	}
+	if !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+		if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+	}
+	return []string{unquote(value)}
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Consul KV, cas=0 creates the key only if it does not exist, same as ETCD v2 prevExist=false
+type consulStore struct {
+	endpoint string
+	token    string
+}
+
+type ConsulKV struct {
+	Key         string
+	Value       []byte // base64 in JSON
+	ModifyIndex uint64
+}
+
+func newConsulStore(address string) *consulStore {
+	endpoint := address
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return &consulStore{endpoint: strings.TrimSuffix(endpoint, "/"), token: os.Getenv("CONSUL_HTTP_TOKEN")}
+}
+
+// Consul keys have no leading slash
+func consulKey(index int) string {
+	return strings.TrimPrefix(etcdKey(etcdPrefix, tagPrefix, tagName, index), "/")
+}
+
+func (c *consulStore) do(method string, path string, body string) (res *http.Response, err error) {
+	url := c.endpoint + "/v1/kv/" + path
+	slog.Debug("Consul request", "method", method, "url", url)
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	res, err = httpClient.Do(req)
+	slog.Debug("got", "response", fmt.Sprintf("%+v", res), "error", err)
+	return
+}
+
+// Reads key or keys under prefix with ?recurse, nil if there is none
+func (c *consulStore) read(path string) (kvs []ConsulKV, err error) {
+	res, err := c.do("GET", path, "")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Don't know how to handle Consul reply %+v", res))
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	slog.Debug("got", "body", string(bin))
+	err = json.Unmarshal(bin, &kvs)
+	return
+}
+
+// Consul replies true or false to cas writes, false is the equivalent of ETCD PreconditionFailed
+func (c *consulStore) cas(method string, path string, body string) (ok bool, err error) {
+	res, err := c.do(method, path, body)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, errors.New(fmt.Sprintf("Don't know how to handle Consul reply %+v", res))
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	return strings.TrimSpace(string(bin)) == "true", nil
+}
+
+func (c *consulStore) List() (values map[int]string, err error) {
+	kvs, err := c.read(strings.TrimPrefix(etcdDir(etcdPrefix, tagPrefix, tagName), "/") + "/?recurse")
+	if err != nil || kvs == nil {
+		return
+	}
+	values = make(map[int]string)
+	for _, kv := range kvs {
+		if index := etcdKeyIndex(kv.Key); index >= 0 {
+			values[index] = string(kv.Value)
+		}
+	}
+	return values, nil
+}
+
+func (c *consulStore) Get(index int) (value string, err error) {
+	kvs, err := c.read(consulKey(index))
+	if err != nil || len(kvs) == 0 {
+		return
+	}
+	return string(kvs[0].Value), nil
+}
+
+func (c *consulStore) CreateIfAbsent(index int, value string) (ok bool, err error) {
+	return c.cas("PUT", consulKey(index)+"?cas=0", value)
+}
+
+// -index-ttl would need Consul sessions, run() refuses the combination
+func (c *consulStore) Refresh(index int, value string) error {
+	return errors.New("Consul index TTL is not supported")
+}
+
+// Consul compares modify index, not value, so the value is checked first
+func (c *consulStore) Delete(index int, prevValue string) (ok bool, err error) {
+	kvs, err := c.read(consulKey(index))
+	if err != nil || len(kvs) == 0 || string(kvs[0].Value) != prevValue {
+		return
+	}
+	return c.cas("DELETE", fmt.Sprintf("%s?cas=%d", consulKey(index), kvs[0].ModifyIndex), "")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DynamoDB table with `slot` string partition key, holding `value` and, with -index-ttl, `expires` epoch seconds
+// to be used as the table TTL attribute; expired items are treated as free until DynamoDB deletes them
+type dynamoStore struct {
+	table  string
+	region string // resolved on first call, -region or instance metadata
+}
+
+type DynamoAttr struct {
+	S string `json:",omitempty"`
+	N string `json:",omitempty"`
+}
+
+type DynamoItem map[string]DynamoAttr
+
+type DynamoRequest struct {
+	TableName                 string
+	Key                       DynamoItem        `json:",omitempty"`
+	Item                      DynamoItem        `json:",omitempty"`
+	ConsistentRead            bool              `json:",omitempty"`
+	ConditionExpression       string            `json:",omitempty"`
+	UpdateExpression          string            `json:",omitempty"`
+	FilterExpression          string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues DynamoItem        `json:",omitempty"`
+	ExclusiveStartKey         DynamoItem        `json:",omitempty"`
+}
+
+type DynamoResponse struct {
+	Item             DynamoItem
+	Items            []DynamoItem
+	LastEvaluatedKey DynamoItem
+}
+
+func newDynamoStore(table string) *dynamoStore {
+	return &dynamoStore{table: table}
+}
+
+func dynamoSlotPrefix() string {
+	return etcdDir(etcdPrefix, tagPrefix, tagName) + "#"
+}
+
+func dynamoKey(index int) DynamoItem {
+	return DynamoItem{"slot": DynamoAttr{S: dynamoSlotPrefix() + strconv.Itoa(index)}}
+}
+
+func dynamoNow() DynamoAttr {
+	return DynamoAttr{N: strconv.FormatInt(time.Now().Unix(), 10)}
+}
+
+func dynamoExpires() DynamoAttr {
+	return DynamoAttr{N: strconv.FormatInt(time.Now().Add(indexTtl).Unix(), 10)}
+}
+
+// Value of the item, empty if the item is absent or expired
+func dynamoValue(item DynamoItem) string {
+	if item == nil {
+		return ""
+	}
+	if expires, err := strconv.ParseInt(item["expires"].N, 10, 64); err == nil && expires < time.Now().Unix() {
+		return ""
+	}
+	return item["value"].S
+}
+
+func (d *dynamoStore) call(action string, request *DynamoRequest) (response DynamoResponse, err error) {
+	if d.region == "" {
+		d.region, err = storeRegion()
+		if err != nil {
+			return
+		}
+	}
+	auth, err := awsAuth()
+	if err != nil {
+		return
+	}
+	endpoint := "https://dynamodb." + d.region + ".amazonaws.com/"
+	if awsEndpoint != "" {
+		endpoint = awsEndpoint + "/"
+	}
+	request.TableName = d.table
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	var bin []byte
+	err = awsRetry(func() error {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(string(body)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+		req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+action)
+		bin, err = awsSend(auth, aws.Region{Name: d.region}, "dynamodb", req)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(bin, &response)
+	return
+}
+
+// Failed condition is the equivalent of ETCD PreconditionFailed
+func (d *dynamoStore) conditional(action string, request *DynamoRequest) (ok bool, err error) {
+	_, err = d.call(action, request)
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailedException") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Scans the table for the slots under -etcd-prefix, fine for tables holding a few hundred slots
+func (d *dynamoStore) List() (values map[int]string, err error) {
+	prefix := dynamoSlotPrefix()
+	values = make(map[int]string)
+	var start DynamoItem
+	for {
+		res, err := d.call("Scan", &DynamoRequest{
+			ConsistentRead:            true,
+			FilterExpression:          "begins_with(#s, :prefix)",
+			ExpressionAttributeNames:  map[string]string{"#s": "slot"},
+			ExpressionAttributeValues: DynamoItem{":prefix": DynamoAttr{S: prefix}},
+			ExclusiveStartKey:         start,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range res.Items {
+			index, err := strconv.Atoi(strings.TrimPrefix(item["slot"].S, prefix))
+			if value := dynamoValue(item); err == nil && value != "" {
+				values[index] = value
+			}
+		}
+		if len(res.LastEvaluatedKey) == 0 {
+			return values, nil
+		}
+		slog.Debug("DynamoDB scan continues", "start", fmt.Sprintf("%+v", res.LastEvaluatedKey))
+		start = res.LastEvaluatedKey
+	}
+}
+
+func (d *dynamoStore) Get(index int) (value string, err error) {
+	res, err := d.call("GetItem", &DynamoRequest{Key: dynamoKey(index), ConsistentRead: true})
+	if err != nil {
+		return
+	}
+	return dynamoValue(res.Item), nil
+}
+
+func (d *dynamoStore) CreateIfAbsent(index int, value string) (ok bool, err error) {
+	item := dynamoKey(index)
+	item["value"] = DynamoAttr{S: value}
+	if indexTtl > 0 {
+		item["expires"] = dynamoExpires()
+	}
+	return d.conditional("PutItem", &DynamoRequest{
+		Item:                      item,
+		ConditionExpression:       "attribute_not_exists(#s) OR #e < :now",
+		ExpressionAttributeNames:  map[string]string{"#s": "slot", "#e": "expires"},
+		ExpressionAttributeValues: DynamoItem{":now": dynamoNow()},
+	})
+}
+
+func (d *dynamoStore) Refresh(index int, value string) error {
+	ok, err := d.conditional("UpdateItem", &DynamoRequest{
+		Key:                       dynamoKey(index),
+		UpdateExpression:          "SET #e = :expires",
+		ConditionExpression:       "#v = :value",
+		ExpressionAttributeNames:  map[string]string{"#v": "value", "#e": "expires"},
+		ExpressionAttributeValues: DynamoItem{":value": DynamoAttr{S: value}, ":expires": dynamoExpires()},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("Cannot refresh TTL of machine index %d, DynamoDB item changed", index))
+	}
+	return nil
+}
+
+func (d *dynamoStore) Delete(index int, prevValue string) (ok bool, err error) {
+	return d.conditional("DeleteItem", &DynamoRequest{
+		Key:                       dynamoKey(index),
+		ConditionExpression:       "#v = :value", // value is a reserved word
+		ExpressionAttributeNames:  map[string]string{"#v": "value"},
+		ExpressionAttributeValues: DynamoItem{":value": DynamoAttr{S: prevValue}},
+	})
+}
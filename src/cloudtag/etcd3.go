@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+)
+
+// ETCD v3 gRPC-gateway JSON messages, []byte fields are base64 encoded by encoding/json
+
+type Etcd3KeyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision string `json:"create_revision,omitempty"`
+}
+
+type Etcd3RangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type Etcd3RangeResponse struct {
+	Kvs   []Etcd3KeyValue `json:"kvs"`
+	Count string          `json:"count"`
+}
+
+type Etcd3Compare struct {
+	Key            []byte `json:"key"`
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+type Etcd3PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type Etcd3DeleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+type Etcd3RequestOp struct {
+	RequestPut         *Etcd3PutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *Etcd3DeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type Etcd3TxnRequest struct {
+	Compare []Etcd3Compare   `json:"compare"`
+	Success []Etcd3RequestOp `json:"success"`
+}
+
+type Etcd3TxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+func etcd3Call(endpoint string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	slog.Debug("ETCD v3 request", "endpoint", endpoint, "body", string(body))
+	res, err := etcdDo("POST", "/v3/kv/"+endpoint, "application/json", string(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	bin, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v: %s", res, bin))
+	}
+	slog.Debug("got", "body", string(bin))
+	return json.Unmarshal(bin, response)
+}
+
+// ETCD v3 JSON gateway
+type etcd3Store struct{}
+
+func (etcd3Store) Get(index int) (value string, err error) {
+	key := etcdKey(etcdPrefix, tagPrefix, tagName, index)
+	var res Etcd3RangeResponse
+	err = etcd3Call("range", &Etcd3RangeRequest{Key: []byte(key)}, &res)
+	if err != nil {
+		return
+	}
+	if len(res.Kvs) == 0 {
+		return "", nil
+	}
+	return string(res.Kvs[0].Value), nil
+}
+
+// All keys under the index prefix, range end is the prefix with last byte incremented
+func (etcd3Store) List() (values map[int]string, err error) {
+	prefix := []byte(etcdDir(etcdPrefix, tagPrefix, tagName) + "/")
+	end := append([]byte{}, prefix...)
+	end[len(end)-1]++
+	var res Etcd3RangeResponse
+	err = etcd3Call("range", &Etcd3RangeRequest{Key: prefix, RangeEnd: end}, &res)
+	if err != nil {
+		return
+	}
+	values = make(map[int]string)
+	for _, kv := range res.Kvs {
+		if index := etcdKeyIndex(string(kv.Key)); index >= 0 {
+			values[index] = string(kv.Value)
+		}
+	}
+	return values, nil
+}
+
+// create-revision == 0 means the key does not exist, same as v2 prevExist=false
+func (etcd3Store) CreateIfAbsent(index int, value string) (ok bool, err error) {
+	key := []byte(etcdKey(etcdPrefix, tagPrefix, tagName, index))
+	txn := &Etcd3TxnRequest{
+		Compare: []Etcd3Compare{Etcd3Compare{Key: key, Result: "EQUAL", Target: "CREATE", CreateRevision: "0"}},
+		Success: []Etcd3RequestOp{Etcd3RequestOp{RequestPut: &Etcd3PutRequest{Key: key, Value: []byte(value)}}},
+	}
+	var res Etcd3TxnResponse
+	err = etcd3Call("txn", txn, &res)
+	if err != nil {
+		return
+	}
+	return res.Succeeded, nil
+}
+
+// Deletes the key only if it still holds the value, compare-and-delete
+func (etcd3Store) Delete(index int, value string) (ok bool, err error) {
+	key := []byte(etcdKey(etcdPrefix, tagPrefix, tagName, index))
+	txn := &Etcd3TxnRequest{
+		Compare: []Etcd3Compare{Etcd3Compare{Key: key, Result: "EQUAL", Target: "VALUE", Value: []byte(value)}},
+		Success: []Etcd3RequestOp{Etcd3RequestOp{RequestDeleteRange: &Etcd3DeleteRangeRequest{Key: key}}},
+	}
+	var res Etcd3TxnResponse
+	err = etcd3Call("txn", txn, &res)
+	if err != nil {
+		return
+	}
+	return res.Succeeded, nil
+}
+
+// -index-ttl is v2 only, run() refuses the combination
+func (etcd3Store) Refresh(index int, value string) error {
+	return errors.New("ETCD v3 index TTL is not supported")
+}
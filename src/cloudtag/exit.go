@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+)
+
+// Exit codes by failure class, so that orchestration can tell what went wrong;
+// bad flags and other errors exit with 1
+const (
+	exitEtcd     = 2
+	exitMetadata = 3
+	exitTag      = 4
+	exitDns      = 5
+	exitFile     = 6 // -index-file, -hosts-file, -env-file
+	exitTimeout  = 7
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func failure(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return 1
+}
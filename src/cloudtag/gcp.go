@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	gcpMetadataUrl = "http://metadata.google.internal/computeMetadata/v1/"
+	gcpComputeUrl  = "https://compute.googleapis.com/compute/v1/"
+	gcpTokenPath   = "instance/service-accounts/default/token"
+)
+
+// Google Compute Engine, tags are set as instance labels
+type gcpCloud struct {
+	project string
+	zone    string
+}
+
+func (c *gcpCloud) Identity() (instance string, zone string, region string, err error) {
+	c.project, err = gcpMetadata("project/project-id")
+	if err != nil {
+		return
+	}
+	instance, err = gcpMetadata("instance/name")
+	if err != nil {
+		return
+	}
+	zone, err = gcpMetadata("instance/zone") // projects/123456/zones/us-central1-a
+	if err != nil {
+		return
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	if strings.LastIndex(zone, "-") <= 0 {
+		err = errors.New(fmt.Sprintf("Cannot determine region of GCE zone `%s`", zone))
+		return
+	}
+	c.zone = zone
+	region = zone[0:strings.LastIndex(zone, "-")]
+	return
+}
+
+type GcpInstance struct {
+	Labels           map[string]string `json:"labels"`
+	LabelFingerprint string            `json:"labelFingerprint"`
+}
+
+func (c *gcpCloud) Tag(m *Machine) error {
+	return c.setLabels(m, func(labels map[string]string, key string, value string) {
+		labels[key] = value
+	})
+}
+
+func (c *gcpCloud) Untag(m *Machine) error {
+	return c.setLabels(m, func(labels map[string]string, key string, value string) {
+		if labels[key] == value {
+			delete(labels, key)
+		}
+	})
+}
+
+func (c *gcpCloud) setLabels(m *Machine, change func(labels map[string]string, key string, value string)) error {
+	url := fmt.Sprintf("%sprojects/%s/zones/%s/instances/%s", gcpComputeUrl, c.project, c.zone, m.Instance)
+	var instance GcpInstance
+	err := gcpCall("GET", url, nil, &instance)
+	if err != nil {
+		return err
+	}
+	if instance.Labels == nil {
+		instance.Labels = make(map[string]string)
+	}
+	tags, err := instanceTags(m)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		change(instance.Labels, gcpLabel(tag.Key), gcpLabel(tag.Value))
+	}
+	return gcpCall("POST", url+"/setLabels", &instance, nil)
+}
+
+// Label keys and values are lowercase letters, digits, `_`, and `-`, up to 63 characters
+func gcpLabel(value string) string {
+	label := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(value))
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+func gcpMetadata(what string) (value string, err error) {
+	return metadataRetry(what, gcpMetadataOnce)
+}
+
+// The metadata server at -metadata-url, gcpMetadataUrl by default
+func gcpMetadataOnce(what string) (value string, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataUrl+what, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := metadataClient.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", true, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, errors.New(fmt.Sprintf("Cannot read GCE metadata %v, got %v", what, res.Status))
+	}
+	value = strings.TrimSpace(string(bin))
+	if what == gcpTokenPath {
+		// a working OAuth bearer token
+		slog.Debug("metadata", "path", what)
+	} else {
+		slog.Debug("metadata", "path", what, "value", value)
+	}
+	return
+}
+
+type GcpToken struct {
+	AccessToken string `json:"access_token"`
+}
+
+func gcpCall(method string, url string, request interface{}, response interface{}) error {
+	bin, err := gcpMetadata(gcpTokenPath)
+	if err != nil {
+		return err
+	}
+	var token GcpToken
+	err = json.Unmarshal([]byte(bin), &token)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if request != nil {
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	slog.Debug("sending", "method", method, "url", url, "body", string(body))
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	reply, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	slog.Debug("got", "status", res.Status, "body", string(reply))
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("%s %s failed with %v: %s", method, url, res.Status, reply))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(reply, response)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readyz fails once the last successful reconcile is older than this many -watch-interval
+const healthStaleFactor = 3
+
+var lastReconcile atomic.Int64 // unix nanoseconds
+
+func markReconciled() {
+	lastReconcile.Store(time.Now().UnixNano())
+}
+
+// /healthz answers while the process is alive, /readyz while tag and DNS record are kept up to date
+func serveHealth(addr string, interval time.Duration) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		last := lastReconcile.Load()
+		age := time.Since(time.Unix(0, last))
+		if last == 0 || age > healthStaleFactor*interval {
+			http.Error(w, fmt.Sprintf("last reconcile %v ago", age.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Debug("serving health checks", "addr", listener.Addr().String())
+	go func() {
+		err := http.Serve(listener, mux)
+		slog.Warn("Health check server stopped", "error", err)
+	}()
+	return nil
+}
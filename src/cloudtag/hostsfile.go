@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	hostsBegin = "# BEGIN cloudtag managed block, do not edit"
+	hostsEnd   = "# END cloudtag"
+)
+
+// Replaces the managed block of the hosts file with the ip and names line, other lines are kept as is
+func updateHostsFile(path string, ip string, names []string) error {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	managed := false
+	for _, line := range strings.Split(strings.TrimRight(string(bin), "\n"), "\n") {
+		switch {
+		case line == hostsBegin:
+			managed = true
+		case line == hostsEnd && managed:
+			managed = false
+		case !managed && (line != "" || len(lines) > 0):
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, hostsBegin, ip+" "+strings.Join(names, " "), hostsEnd)
+	return writeFileAtomic(path, strings.Join(lines, "\n")+"\n")
+}
+
+// Machine name without the zone, and the full name if there is a zone
+func hostsNames(m *Machine) ([]string, error) {
+	if len(dnsZones) == 0 {
+		name, err := dnsName(m, "")
+		if err != nil {
+			return nil, err
+		}
+		return []string{strings.TrimSuffix(name, ".")}, nil
+	}
+	fqdn, err := dnsName(m, dnsZones[0])
+	if err != nil {
+		return nil, err
+	}
+	short := strings.TrimSuffix(fqdn, "."+dnsZones[0])
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if short == dnsZones[0] {
+		return []string{fqdn}, nil
+	}
+	return []string{fqdn, short}, nil
+}
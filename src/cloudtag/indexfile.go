@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Reads the index saved by previous run, either bare number or CLOUDTAG_INDEX=N
+func readIndexFile(path string) (int, error) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(bin))
+	value = strings.TrimPrefix(value, "CLOUDTAG_INDEX=")
+	return strconv.Atoi(value)
+}
+
+func writeIndexFile(path string, index int) error {
+	content := fmt.Sprintf("%d\n", index)
+	if indexFileFormat == "env" {
+		content = fmt.Sprintf("CLOUDTAG_INDEX=%d\n", index)
+	}
+	return writeFileAtomic(path, content)
+}
+
+// Writes via temporary file and rename, so that readers never see partial content
+func writeFileAtomic(path string, content string) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Machine identity for other units, in systemd EnvironmentFile= syntax
+func writeEnvFile(path string, m *Machine) error {
+	fqdn := ""
+	if len(dnsZones) > 0 {
+		name, err := dnsName(m, dnsZones[0])
+		if err != nil {
+			return err
+		}
+		fqdn = strings.TrimSuffix(name, ".")
+	}
+	name, err := tagValue(m)
+	if err != nil {
+		return err
+	}
+	var content strings.Builder
+	for _, kv := range [][2]string{
+		{"CLOUDTAG_INDEX", formatIndex(m.Index)},
+		{"CLOUDTAG_NAME", name},
+		{"CLOUDTAG_FQDN", fqdn},
+		{"CLOUDTAG_REGION", m.Region},
+	} {
+		fmt.Fprintf(&content, "%s=%s\n", kv[0], envQuote(kv[1]))
+	}
+	return writeFileAtomic(path, content.String())
+}
+
+// Double quotes values systemd would otherwise split or unescape
+func envQuote(value string) string {
+	if !strings.ContainsAny(value, " \t\"'\\$#;") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
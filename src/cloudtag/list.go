@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+type Assignment struct {
+	Index int `json:"index"`
+	EtcdValue
+}
+
+// list command, prints which machine holds which index
+func listCommand() error {
+	if listFormat != "table" && listFormat != "json" {
+		return errors.New(fmt.Sprintf("format must be one of table, json, got `%s`", listFormat))
+	}
+	values, err := store.List()
+	if err != nil {
+		return err
+	}
+	assignments := []Assignment{}
+	for index, value := range values {
+		assignments = append(assignments, Assignment{Index: index, EtcdValue: parseEtcdValue(value)})
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].Index < assignments[j].Index
+	})
+	if listFormat == "json" {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(assignments)
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "INDEX\tMACHINE ID\tHOSTNAME\tINSTANCE\tUPDATED")
+	for _, a := range assignments {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\n", a.Index, a.MachineId, a.Hostname, a.InstanceId, a.Updated)
+	}
+	return out.Flush()
+}
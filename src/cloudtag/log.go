@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// In JSON mode plain log package output (log.Fatal) is routed through slog default handler,
+// so every line becomes a JSON object carrying the context added by logWith().
+func setupLog() error {
+	levels := map[string]slog.Level{"error": slog.LevelError, "warn": slog.LevelWarn, "info": slog.LevelInfo, "debug": slog.LevelDebug}
+	level, ok := levels[logLevel]
+	if !ok {
+		return errors.New(fmt.Sprintf("log-level must be one of error, warn, info, debug, got `%s`", logLevel))
+	}
+	if logFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	} else {
+		slog.SetLogLoggerLevel(level)
+	}
+	return nil
+}
+
+func logWith(args ...any) {
+	if logFormat == "json" {
+		slog.SetDefault(slog.Default().With(args...))
+	}
+}
@@ -1,343 +1,2158 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/ec2"
 	r53 "github.com/mitchellh/goamz/route53"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 var (
-	etcdAddress string
-	etcdPrefix  string
-	tagName     string
-	tagPrefix   string
-	stackName   string
-	dnsZone     string
-	delay       int
-	verbose     bool
+	etcdAddress        string
+	etcdPrefix         string
+	tagName            string
+	tagPrefix          string
+	stackName          string
+	dnsZone            string
+	delay              time.Duration
+	retagCount         int
+	retagInterval      time.Duration
+	verifyTag          bool
+	cloudwatch         bool
+	snsTopicArn        string
+	verbose            bool
+	imdsVersion        string
+	metadataUrl        string
+	metadataRetries    int
+	metadataRetryDelay time.Duration
+	metadataCacheTtl   time.Duration
+	httpTimeout        time.Duration
+	timeout            time.Duration
+	awsRetries         int
+	awsRetryDelay      time.Duration
+	assumeRoleArn      string
+	dnsAssumeRoleArn   string
+	externalId         string
+	awsEndpoint        string
+	dnsIpv6            bool
+	dnsIpSource        string
+	etcdApi            string
+	backend            string
+	consulAddress      string
+	ddbTable           string
+	s3Bucket           string
+	s3Prefix           string
+	etcdUser           string
+	etcdPassword       string
+	etcdScheme         string
+	maxIndex           int
+	indexStart         int
+	indexWidth         int
+	maxEtcdRedirects   int
+	indexTtl           time.Duration
+	watch              bool
+	watchInterval      time.Duration
+	healthAddr         string
+	releaseIndex       int
+	releaseMachineId   string
+	listFormat         string
+	releaseOnExit      bool
+	reclaimStale       bool
+	deregisterOnExit   bool
+	logFormat          string
+	logLevel           string
+	dryRun             bool
+	printVersion       bool
+	printIndex         bool
+	printChangeId      bool
+	indexFile          string
+	indexFileFormat    string
+	hostsFile          string
+	envFile            string
+	machineIdPath      string
+	machineIdSource    string
+	indexWait          time.Duration
+	configFile         string
+	identityDoc        bool
+	readUserData       bool
+	tagTemplate        string
+	tagVolumes         bool
+	tagEni             bool
+	tagEniAll          bool
+	volumeTagTemplate  string
+	tagExtra           stringList
+	alsoTagResources   stringList
+	indexTagName       string
+	stableTagName      string
+	azTagName          string
+	regionTagName      string
+	cloudName          string
+	regionOverride     string
+	instanceIdOverride string
+	publicIpOverride   string
+	dnsPrivate         bool
+	dnsTtl             int
+	dnsWait            time.Duration
+	dnsType            string
+	dnsTarget          string
+	dnsAliasTarget     string
+	dnsAliasHealth     bool
+	dnsWeight          int
+	dnsTxt             bool
+	dnsSetIdentifier   string
+	dnsExtra           stringList
+	dnsPrune           bool
+	dnsPtr             bool
+	dnsNameTemplate    string
+	ptrZone            string
+	etcdCaFile         string
+	etcdCertFile       string
+	etcdKeyFile        string
+	etcdInsecure       bool
+	etcdQuorum         bool
+	etcdByStack        bool
+	etcdByRegion       bool
+	etcdRetryDelay     time.Duration
+	etcdRetryTimeout   time.Duration
+	proxyUrl           string
+
+	httpClient     *http.Client
+	metadataClient *http.Client // never proxied
+	etcdClient     *http.Client
+
+	// cancelled on -timeout until the machine is tagged, http requests are made with it
+	ctx = context.Background()
+
+	tagTmpl      *template.Template
+	volumeTmpl   *template.Template
+	dnsNameTmpl  *template.Template
+	tagExtraKey  []string
+	tagExtraTmpl []*template.Template
+
+	etcdEndpoints []string
+	etcdCurrent   int
+
+	command string // subcommand, empty to allocate and tag
+
+	dnsZones   []string          // -dns-zone split, with trailing dots
+	dnsZoneIds map[string]string // looked up once per zone
+	dnsAlias   *r53.AliasTarget  // -dns-alias-target parsed
+
+	instanceId   string // recorded in ETCD index value
+	indexClaimed bool   // the slot was created by this run rather than found held by us
+	etcdRegion   string // the region directory level with -etcd-namespace-by-region
+)
+
+// set at build time with -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 const (
-	machineIdFile    = "/etc/machine-id"
-	maxMachineIndex  = 100
-	maxEtcdRedirects = 10
+	machineIdFile     = "/etc/machine-id"
+	dbusMachineIdFile = "/var/lib/dbus/machine-id"
+	metadataTokenTTL  = 21600
+	indexWaitPause    = 5 * time.Second
+	dnsWaitPause      = 5 * time.Second
+	verifyTagWindow   = 30 * time.Second
+	verifyTagPause    = 3 * time.Second
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func run() (err error) {
+	/*
+	  parse args
+	  read /etc/machine-id
+	  connect etcd
+	  find or grab an index under etcd /prefix and write machine-id into it
+	  determine aws region and instance-id from metadata
+	  connect aws (using IAM role granted to instance)
+	  tag instance as {prefix}{index}
+	  write A record {prefix}{index} into R53 zone
+	*/
+	started := time.Now()
+	parseFlags()
+	if printVersion {
+		fmt.Printf("cloudtag %s, commit %s, built %s\n", version, commit, buildDate)
+		return nil
+	}
+	// first, so that user-data may give logging, proxy, and ETCD auth options too
+	if readUserData {
+		if cloudName != "aws" {
+			return errors.New("read-user-data is supported on aws only")
+		}
+		metadataClient = newMetadataClient()
+		err = loadUserData()
+		if err != nil {
+			return failure(exitMetadata, err)
+		}
+		if cloudName != "aws" {
+			return errors.New("cloud cannot be set from user-data, it is read on aws only")
+		}
+	}
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("log-format must be one of text, json, got `%s`", logFormat)
+	}
+	if verbose {
+		logLevel = "debug"
+	}
+	err = setupLog()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if etcdPassword == "" {
+		etcdPassword = os.Getenv("ETCD_PASSWORD")
+	}
+	err = setupProxy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpClient = &http.Client{Timeout: httpTimeout}
+	stopTimeout := func() {}
+	onTimeout := func() {}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		stopTimeout = func() {
+			cancel()
+			ctx = context.Background()
+		}
+		// requests and retry sleeps give up once ctx is done, the error they return ends up here
+		defer func() {
+			if err == nil || ctx.Err() != context.DeadlineExceeded {
+				return
+			}
+			ctx = context.Background()
+			onTimeout()
+			err = failure(exitTimeout, errors.New(fmt.Sprintf("Timed out after %v before the machine was tagged: %v", timeout, err)))
+		}()
+	}
+	if !strings.HasPrefix(etcdPrefix, "/") {
+		log.Fatalf("etcd-prefix must start with `/`, got `%s`", etcdPrefix)
+	}
+	if indexStart < 0 {
+		log.Fatalf("index-start must not be negative, got %d", indexStart)
+	}
+	if maxIndex <= indexStart {
+		log.Fatalf("max-index must be greater than index-start %d, got %d", indexStart, maxIndex)
+	}
+	if etcdScheme != "http" && etcdScheme != "https" {
+		log.Fatalf("etcd-scheme must be one of http, https, got `%s`", etcdScheme)
+	}
+	if etcdApi != "v2" && etcdApi != "v3" {
+		log.Fatalf("etcd-api must be one of v2, v3, got `%s`", etcdApi)
+	}
+	for _, address := range strings.Split(etcdAddress, ",") {
+		etcdEndpoints = append(etcdEndpoints, strings.TrimSuffix(etcdEndpoint(strings.TrimSpace(address)), "/"))
+	}
+	etcdClient, err = newEtcdClient()
+	if err != nil {
+		return failure(exitEtcd, err)
+	}
+	if indexTtl != 0 && indexTtl < time.Second {
+		log.Fatalf("index-ttl must be at least 1s, got %v", indexTtl)
+	}
+	if indexTtl > 0 && (backend != "etcd" || etcdApi != "v2") && backend != "dynamodb" {
+		log.Fatal("index-ttl is only supported with -backend etcd -etcd-api v2 or -backend dynamodb")
+	}
+	switch backend {
+	case "etcd":
+		if etcdApi == "v3" {
+			store = etcd3Store{}
+		} else {
+			store = &etcd2Store{}
+		}
+	case "consul":
+		store = newConsulStore(consulAddress)
+	case "dynamodb":
+		if ddbTable == "" {
+			log.Fatal("ddb-table is required with -backend dynamodb")
+		}
+		store = newDynamoStore(ddbTable)
+	case "s3":
+		if s3Bucket == "" {
+			log.Fatal("s3-bucket is required with -backend s3")
+		}
+		store = newS3Store(s3Bucket)
+	default:
+		log.Fatalf("backend must be one of etcd, consul, dynamodb, s3, got `%s`", backend)
+	}
+	if command == "release" || command == "list" {
+		if etcdByRegion {
+			if regionOverride == "" {
+				log.Fatal("etcd-namespace-by-region requires -region with release and list")
+			}
+			etcdRegion = regionOverride
+		}
+		if command == "release" {
+			err = release()
+		} else {
+			err = listCommand()
+		}
+		if err != nil {
+			return failure(exitEtcd, err)
+		}
+		return nil
+	}
+	if indexTtl > 0 && !watch {
+		log.Fatal("index-ttl requires -watch")
+	}
+	if watch && watchInterval <= 0 {
+		log.Fatalf("watch-interval must be positive, got %v", watchInterval)
+	}
+	if healthAddr != "" && !watch {
+		log.Fatal("health-addr requires -watch")
+	}
+	if imdsVersion != "auto" && imdsVersion != "v1" && imdsVersion != "v2" {
+		log.Fatalf("imds-version must be one of auto, v1, v2, got `%s`", imdsVersion)
+	}
+	metadataUrlSet := false
+	flag.Visit(func(f *flag.Flag) { metadataUrlSet = metadataUrlSet || f.Name == "metadata-url" })
+	if !metadataUrlSet && cloudName == "gcp" {
+		metadataUrl = gcpMetadataUrl
+	} else if !metadataUrlSet && cloudName == "azure" {
+		metadataUrl = azureMetadataUrl
+	}
+	if !strings.HasSuffix(metadataUrl, "/") {
+		metadataUrl = metadataUrl + "/"
+	}
+	if dnsType != "A" && dnsType != "CNAME" {
+		log.Fatalf("dns-type must be one of A, CNAME, got `%s`", dnsType)
+	}
+	if dnsType == "CNAME" && dnsIpv6 {
+		log.Fatal("dns-ipv6 cannot be used with CNAME record, no other records may share the name")
+	}
+	if dnsTtl <= 0 {
+		log.Fatalf("dns-ttl must be positive, got %d", dnsTtl)
+	}
+	if dnsWeight < 0 || dnsWeight > 255 {
+		log.Fatalf("dns-weight must be between 0 and 255, got %d", dnsWeight)
+	}
+	if dnsSetIdentifier != "" && dnsWeight == 0 {
+		log.Fatal("dns-set-identifier requires dns-weight")
+	}
+	if dnsAliasTarget != "" {
+		at := strings.LastIndex(dnsAliasTarget, "@")
+		if at <= 0 || at == len(dnsAliasTarget)-1 {
+			log.Fatalf("dns-alias-target must be dns-name@hosted-zone-id, got `%s`", dnsAliasTarget)
+		}
+		if dnsType != "A" || dnsTarget != "" || dnsIpv6 || dnsPtr {
+			log.Fatal("dns-alias-target cannot be used together with CNAME dns-type, dns-target, dns-ipv6, or dns-ptr")
+		}
+		name := dnsAliasTarget[:at]
+		if !strings.HasSuffix(name, ".") {
+			name = name + "."
+		}
+		dnsAlias = &r53.AliasTarget{DNSName: name, HostedZoneId: dnsAliasTarget[at+1:], EvaluateTargetHealth: dnsAliasHealth}
+	}
+	if dnsIpSource != "public" && dnsIpSource != "private" {
+		log.Fatalf("dns-ip-source must be one of public, private, got `%s`", dnsIpSource)
+	}
+	if regionOverride != "" && azTagName != "" && cloudName == "aws" {
+		log.Fatal("az-tag-name cannot be used together with region, the availability zone is not looked up then")
+	}
+	if (cloudwatch || snsTopicArn != "") && cloudName != "aws" {
+		log.Fatal("cloudwatch and sns-topic-arn are supported on aws only")
+	}
+	if identityDoc && cloudName != "aws" {
+		log.Fatal("identity-doc is supported on aws only")
+	}
+	if verifyTag && cloudName != "aws" {
+		log.Fatal("verify-tag is supported on aws only")
+	}
+	if tagVolumes && (cloudName != "aws" || tagName == "") {
+		log.Fatal("tag-volumes requires tag-name and is supported on aws only")
+	}
+	if (tagEni || tagEniAll) && cloudName != "aws" {
+		log.Fatal("tag-eni is supported on aws only")
+	}
+	for _, id := range alsoTagResources {
+		if cloudName != "aws" {
+			log.Fatal("also-tag-resource is supported on aws only")
+		}
+		if !awsResourceId.MatchString(id) {
+			log.Fatalf("also-tag-resource must be an AWS resource id like vol-0123456789abcdef0, got `%s`", id)
+		}
+	}
+	if machineIdSource != "file" && machineIdSource != "instance" {
+		log.Fatalf("machine-id-source must be one of file, instance, got `%s`", machineIdSource)
+	}
+	awsEndpoint = strings.TrimSuffix(awsEndpoint, "/")
+	if indexFileFormat != "plain" && indexFileFormat != "env" {
+		log.Fatalf("index-file-format must be one of plain, env, got `%s`", indexFileFormat)
+	}
+	if hostsFile != "" && (dnsType != "A" || dnsAliasTarget != "" || cloudName != "aws") {
+		log.Fatal("hosts-file requires A record dns-type without dns-alias-target, on aws")
+	}
+	var cloud Cloud
+	switch cloudName {
+	case "aws":
+		cloud = &awsCloud{}
+	case "gcp":
+		cloud = &gcpCloud{}
+	case "azure":
+		cloud = &azureCloud{}
+	default:
+		log.Fatalf("cloud must be one of aws, gcp, azure, got `%s`", cloudName)
+	}
+	if cloudName != "aws" && dnsZone != "" {
+		log.Fatalf("dns-zone is not supported on %s", cloudName)
+	}
+	if dnsZone != "" {
+		for _, zone := range strings.Split(dnsZone, ",") {
+			zone = strings.TrimSpace(zone)
+			if !strings.HasSuffix(zone, ".") {
+				zone = zone + "."
+			}
+			dnsZones = append(dnsZones, zone)
+		}
+	}
+	if dnsPtr {
+		if ptrZone == "" || dnsType != "A" {
+			log.Fatal("dns-ptr requires ptr-zone and A record dns-type")
+		}
+		if !strings.HasSuffix(ptrZone, ".") {
+			ptrZone = ptrZone + "."
+		}
+	}
+	for i, extra := range dnsExtra {
+		parts := strings.SplitN(extra, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("dns-extra must be name=IP or name=self, got `%s`", extra)
+		}
+		name := parts[0]
+		if !strings.HasSuffix(name, ".") {
+			name = name + "."
+		}
+		if recordZone(name) == "" {
+			log.Fatalf("dns-extra name must end with DNS zone %s, got `%s`", dnsZone, parts[0])
+		}
+		if parts[1] != "self" && net.ParseIP(parts[1]) == nil {
+			log.Fatalf("dns-extra value must be IP address or self, got `%s`", parts[1])
+		}
+		dnsExtra[i] = name + "=" + parts[1]
+	}
+
+	dnsNameTmpl, err = parseNameTemplate("dns-name-template", dnsNameTemplate, "zone")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tagTmpl, err = parseNameTemplate("tag-template", tagTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	volumeTmpl = tagTmpl
+	if volumeTagTemplate != "" {
+		volumeTmpl, err = parseNameTemplate("volume-tag-template", volumeTagTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, extra := range tagExtra {
+		parts := strings.SplitN(extra, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("tag must be key=value, got `%s`", extra)
+		}
+		t, err := parseNameTemplate("tag "+parts[0], parts[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		tagExtraKey = append(tagExtraKey, parts[0])
+		tagExtraTmpl = append(tagExtraTmpl, t)
+	}
+
+	if command == "preflight" {
+		return preflight(cloud)
+	}
+
+	instance, availabilityZone, region, err := cloud.Identity()
+	if err != nil {
+		return failure(exitMetadata, err)
+	}
+	if regionOverride != "" {
+		region = regionOverride
+	}
+	instanceId = instance
+	etcdRegion = region
+	mid := instance
+	if machineIdSource == "file" {
+		mid, err = machineId()
+		if err != nil {
+			return failure(exitMetadata, err)
+		}
+	}
+
+	// checked before a slot is taken, so that a bad template does not use up an index; it is a bad option and exits with 1
+	probe := &Machine{Id: mid, Index: indexStart, Instance: instance, Region: region, Zone: availabilityZone}
+	if _, err = instanceTags(probe); err != nil {
+		return fmt.Errorf("Cannot render instance tags: %w", err)
+	}
+	for _, zone := range dnsZones {
+		name, err := dnsName(probe, zone)
+		if err != nil {
+			return fmt.Errorf("Cannot render dns-name-template: %w", err)
+		}
+		if !strings.HasSuffix(name, "."+zone) && name != zone {
+			return fmt.Errorf("dns-name-template must render to a name in zone %s, got `%s`", zone, name)
+		}
+	}
+
+	// listening before a slot is taken, so that a busy port does not leave the index held; /readyz fails until tagged
+	if healthAddr != "" && !dryRun {
+		err = serveHealth(healthAddr, watchInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	index := -1
+	// skip the scan if the index saved by previous run is still ours
+	if indexFile != "" {
+		saved, err := readIndexFile(indexFile)
+		if err == nil && saved >= indexStart && saved < maxIndex {
+			maybe, err := get(saved)
+			if err != nil {
+				return failure(exitEtcd, err)
+			}
+			if maybe == mid {
+				slog.Debug("index from file is still ours", "index", saved, "file", indexFile)
+				index = saved
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			slog.Warn("Cannot read index file", "file", indexFile, "error", err)
+		}
+	}
+	if index < 0 {
+		index, err = waitIndex(mid)
+		if err != nil {
+			return failure(exitEtcd, err)
+		}
+	}
+	if indexClaimed && !dryRun {
+		// a slot taken by this run is given back if the machine is not tagged in time
+		onTimeout = func() {
+			slog.Info("releasing index after timeout", "index", index)
+			_, err := remove(mid, index)
+			if err != nil {
+				slog.Warn("Cannot release index", "index", index, "error", err)
+			}
+		}
+	}
+	if indexFile != "" && !dryRun {
+		err = writeIndexFile(indexFile, index)
+		if err != nil {
+			return failure(exitFile, err)
+		}
+	}
+	if reclaimStale && !dryRun {
+		err = reclaim(mid, index)
+		if err != nil {
+			slog.Warn("Cannot reclaim stale slots", "error", err)
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	if watch || releaseOnExit || deregisterOnExit {
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	}
+	// the slot may have been found already held by us from previous run, extend it
+	if indexTtl > 0 && !dryRun {
+		err = refresh(mid, index)
+		if err != nil {
+			return failure(exitEtcd, err)
+		}
+	}
+
+	ipMetadata := "public-ipv4"
+	if dnsIpSource == "private" {
+		ipMetadata = "local-ipv4"
+	}
+	if dnsType == "CNAME" {
+		ipMetadata = "public-hostname"
+		if dnsIpSource == "private" {
+			ipMetadata = "local-hostname"
+		}
+	}
+	var ip string
+	if (dnsType == "CNAME" && dnsTarget != "") || dnsAlias != nil || cloudName != "aws" {
+		ip = dnsTarget
+	} else if ipMetadata == "public-ipv4" && publicIpOverride != "" {
+		ip = publicIpOverride
+	} else if dnsZone != "" || hostsFile != "" {
+		var found bool
+		ip, found, err = metadataOptional(ipMetadata)
+		if err == nil && !found {
+			if ipMetadata != "public-ipv4" {
+				err = errors.New(fmt.Sprintf("Instance has no %s", ipMetadata))
+			} else {
+				// instances in private subnets have no public IP
+				slog.Warn("Instance has no public IP, using private IP instead")
+				ip, err = metadata("local-ipv4")
+			}
+		}
+		if err != nil {
+			return failure(exitMetadata, err)
+		}
+	}
+	var vpcId string
+	if dnsZone != "" && dnsPrivate {
+		vpcId, err = vpc()
+		if err != nil {
+			return failure(exitMetadata, err)
+		}
+	}
+	var publicIpv6 []string
+	if dnsZone != "" && dnsIpv6 {
+		publicIpv6, err = ipv6()
+		if err != nil {
+			return failure(exitMetadata, err)
+		}
+	}
+
+	m := &Machine{Id: mid, Index: index, Instance: instance, Region: region, Zone: availabilityZone, Vpc: vpcId, Ip: ip, Ipv6: publicIpv6}
+	logWith("index", index, "instance", instance, "region", region)
+	slog.Debug("configuration", "machine_id", mid, "index", index, "region", region, "tag", tagName, "prefix", tagPrefix, "stack", stackName, "dns_zone", dnsZone)
+
+	var r53c *r53.Route53
+	var ec2c *ec2.EC2
+	var credentialsExpire time.Time
+	if cloudName == "aws" {
+		r53c, ec2c, credentialsExpire, err = awsClients(region)
+		if err != nil {
+			return failure(exitTag, err)
+		}
+		cloud.(*awsCloud).ec2c = ec2c
+	}
+	if dryRun {
+		return plan(r53c, m)
+	}
+	var changeIds []string
+	if dnsZone != "" {
+		if dnsPrune {
+			err = pruneDns(r53c, ec2c, m)
+			if err != nil {
+				return failure(exitDns, err)
+			}
+		}
+		changeIds, err = changeDns(r53c, "UPSERT", m)
+		if err != nil {
+			return failure(exitDns, err)
+		}
+	}
+	if tagging() {
+		err = tag(cloud, m)
+		if err != nil {
+			return failure(exitTag, err)
+		}
+	}
+	if hostsFile != "" {
+		names, err := hostsNames(m)
+		if err != nil {
+			return failure(exitDns, err)
+		}
+		err = updateHostsFile(hostsFile, ip, names)
+		if err != nil {
+			return failure(exitFile, err)
+		}
+	}
+	if envFile != "" {
+		err = writeEnvFile(envFile, m)
+		if err != nil {
+			return failure(exitFile, err)
+		}
+	}
+	if cloudwatch {
+		err = putMetrics(m, time.Since(started))
+		if err != nil {
+			slog.Warn("Cannot publish CloudWatch metrics", "error", err)
+		}
+	}
+	if snsTopicArn != "" {
+		err = publishAllocation(m)
+		if err != nil {
+			slog.Warn("Cannot publish allocation to SNS", "topic", snsTopicArn, "error", err)
+		}
+	}
+	if printIndex {
+		fmt.Println(index)
+	}
+	if printChangeId {
+		for _, id := range changeIds {
+			fmt.Println(id)
+		}
+	}
+	stopTimeout()
+	markReconciled()
+	err = sdNotify("READY=1")
+	if err != nil {
+		slog.Warn("Cannot notify systemd", "error", err)
+	}
+
+	if !watch && !releaseOnExit && !deregisterOnExit {
+		return nil
+	}
+	var reconciles, refreshes, watchdogs, credentials <-chan time.Time
+	// instance role and assumed role credentials expire within hours, the exit clean-up needs them too
+	credentials = credentialsRefresh(credentialsExpire)
+	if watch {
+		reconciles = time.Tick(watchInterval)
+		if indexTtl > 0 {
+			refreshes = time.Tick(indexTtl / 3)
+		}
+		if interval := sdWatchdogInterval(); interval > 0 {
+			watchdogs = time.Tick(interval)
+		}
+	}
+	for {
+		select {
+		case <-watchdogs:
+			err = sdNotify("WATCHDOG=1")
+			if err != nil {
+				slog.Warn("Cannot notify systemd watchdog", "error", err)
+			}
+		case <-reconciles:
+			ok := true
+			if tagging() {
+				err = cloud.Tag(m)
+				if err != nil {
+					slog.Warn("Cannot re-apply instance tag", "error", err)
+					ok = false
+				}
+			}
+			if dnsZone != "" {
+				_, err = changeDns(r53c, "UPSERT", m)
+				if err != nil {
+					slog.Warn("Cannot re-apply DNS record", "error", err)
+					ok = false
+				}
+			}
+			if ok {
+				markReconciled()
+			}
+			slog.Debug("re-applied tag and DNS record", "index", index)
+		case <-credentials:
+			_r53c, _ec2c, expires, err := awsClients(region)
+			if err != nil {
+				slog.Warn("Cannot refresh AWS credentials, retrying in a minute", "error", err)
+				credentials = time.After(time.Minute)
+				continue
+			}
+			r53c, ec2c, credentialsExpire = _r53c, _ec2c, expires
+			cloud.(*awsCloud).ec2c = ec2c
+			credentials = credentialsRefresh(credentialsExpire)
+			slog.Debug("refreshed AWS credentials", "expire", credentialsExpire)
+		case <-refreshes:
+			err = refresh(mid, index)
+			if err != nil {
+				return failure(exitEtcd, err)
+			}
+			slog.Debug("refreshed index TTL", "index", index)
+		case sig := <-signals:
+			slog.Info("exiting", "signal", sig.String())
+			if deregisterOnExit && tagging() {
+				err = cloud.Untag(m)
+				if err != nil {
+					slog.Warn("Cannot remove instance tag", "error", err)
+				}
+			}
+			if dnsZone != "" {
+				_, err = changeDns(r53c, "DELETE", m)
+				if err != nil {
+					slog.Warn("Cannot remove DNS record", "error", err)
+				}
+			}
+			if watch || releaseOnExit {
+				slog.Info("releasing index", "index", index)
+				ok, err := remove(mid, index)
+				if err != nil {
+					return failure(exitEtcd, err)
+				}
+				if !ok {
+					slog.Warn("Index is not held by our machine id anymore, not releasing", "index", index, "machine_id", mid)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// Fires five minutes before the credentials expire but not sooner than in a minute, never for static credentials
+func credentialsRefresh(expires time.Time) <-chan time.Time {
+	if expires.IsZero() {
+		return nil
+	}
+	return time.After(max(time.Until(expires)-5*time.Minute, time.Minute))
+}
+
+// What is known about this machine once the index is allocated
+type Machine struct {
+	Id       string // machine-id
+	Index    int
+	Instance string
+	Region   string
+	Zone     string // availability zone
+	Vpc      string // only looked up for -dns-private
+	Ip       string // A record IP or CNAME target
+	Ipv6     []string
+}
+
+// Logs what would be written, -dry-run
+func plan(r53c *r53.Route53, m *Machine) error {
+	tags, err := instanceTags(m)
+	if err != nil {
+		return failure(exitTag, err)
+	}
+	for _, tag := range tags {
+		slog.Info("would set instance tag", "tag", tag.Key, "value", tag.Value)
+	}
+	for _, zone := range dnsZones {
+		zoneId, err := dnsZoneId(r53c, zone, m.Vpc)
+		if err != nil {
+			return failure(exitDns, err)
+		}
+		records, err := dnsRecords(m, zone)
+		if err != nil {
+			return failure(exitDns, err)
+		}
+		for _, record := range records {
+			if record.AliasTarget != nil {
+				slog.Info("would upsert DNS alias record", "zone", zoneId, "name", record.Name, "type", record.Type, "target", record.AliasTarget.DNSName, "target_zone", record.AliasTarget.HostedZoneId)
+				continue
+			}
+			slog.Info("would upsert DNS record", "zone", zoneId, "name", record.Name, "type", record.Type, "ttl", record.TTL, "values", record.Records)
+		}
+	}
+	if dnsZone != "" && dnsPtr {
+		name, err := ptrName(m.Ip)
+		if err != nil {
+			return failure(exitDns, err)
+		}
+		target, err := dnsName(m, dnsZones[0])
+		if err != nil {
+			return failure(exitDns, err)
+		}
+		slog.Info("would upsert DNS record", "zone", ptrZone, "name", name, "type", "PTR", "ttl", dnsTtl, "values", []string{target})
+	}
+	return nil
+}
+
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// Duration flag that also accepts bare number of seconds, as -delay used to be an int
+type secondsDuration time.Duration
+
+func (d *secondsDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *secondsDuration) Set(value string) error {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		*d = secondsDuration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = secondsDuration(parsed)
+	return nil
+}
+
+func parseFlags() {
+	flag.StringVar(&cloudName, "cloud", "aws", "The cloud the instance runs in: aws, gcp, or azure; DNS is supported on aws only")
+	flag.StringVar(&regionOverride, "region", "", "The region to use instead of the one derived from instance availability zone; on aws the zone is not looked up then")
+	flag.StringVar(&instanceIdOverride, "instance-id", "", "The EC2 instance id to use instead of reading it from instance metadata, e.g. to run off-instance")
+	flag.StringVar(&publicIpOverride, "public-ip", "", "The public IP to use for DNS record instead of reading it from instance metadata")
+	flag.StringVar(&backend, "backend", "etcd", "Where machine indexes are allocated: etcd, consul, dynamodb, or s3")
+	flag.StringVar(&consulAddress, "consul", "localhost:8500", "The Consul endpoint for -backend consul, host[:port] or full URL; CONSUL_HTTP_TOKEN environment variable is used as ACL token")
+	flag.StringVar(&ddbTable, "ddb-table", "", "The DynamoDB table for -backend dynamodb, with slot string partition key")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "The S3 bucket for -backend s3")
+	flag.StringVar(&s3Prefix, "s3-prefix", "cloudtag", "The S3 key prefix for -backend s3, objects are <prefix>/<tag-prefix><tag-name>/<index>")
+	flag.StringVar(&etcdAddress, "etcd", "localhost:4001", "The ETCD endpoint, host[:port] or full URL; comma-separated list to fail over between cluster members")
+	flag.StringVar(&etcdPrefix, "etcd-prefix", "/cloudtag", "The directory in ETCD to use for machine index allocation")
+	flag.StringVar(&etcdApi, "etcd-api", "v2", "The ETCD API version to use: v2 keys API or v3 JSON gateway")
+	flag.StringVar(&etcdUser, "etcd-user", "", "The ETCD username for basic authentication")
+	flag.StringVar(&etcdPassword, "etcd-password", "", "The ETCD password for basic authentication, ETCD_PASSWORD environment variable is used if empty")
+	flag.DurationVar(&etcdRetryDelay, "etcd-retry-delay", 500*time.Millisecond, "Initial delay between ETCD retries and repeated redirects, doubled on each attempt with random jitter")
+	flag.DurationVar(&etcdRetryTimeout, "etcd-retry-timeout", 30*time.Second, "How long to retry ETCD requests while all endpoints fail with connection errors, 429, or 5xx replies, 0 to not retry")
+	flag.IntVar(&maxEtcdRedirects, "etcd-max-redirects", 10, "How many ETCD redirects to follow while creating index key, 0 to not follow at all")
+	flag.StringVar(&etcdScheme, "etcd-scheme", "http", "The ETCD endpoint scheme: http or https, unless given in -etcd as full URL")
+	flag.StringVar(&etcdCaFile, "etcd-ca", "", "The CA certificate file to verify https:// ETCD endpoint with")
+	flag.StringVar(&etcdCertFile, "etcd-cert", "", "The client certificate file for https:// ETCD endpoint")
+	flag.StringVar(&etcdKeyFile, "etcd-key", "", "The client certificate key file for https:// ETCD endpoint")
+	flag.BoolVar(&etcdByRegion, "etcd-namespace-by-region", false, "Keep the index keys under a per-region directory {etcd-prefix}/{region}/ so that regions sharing ETCD get independent indexes; combines with -etcd-namespace-by-stack")
+	flag.BoolVar(&etcdByStack, "etcd-namespace-by-stack", false, "Keep the index keys under a per-stack directory {etcd-prefix}/{stack-name}/ so that stacks sharing a tag prefix get independent indexes")
+	flag.BoolVar(&etcdQuorum, "etcd-quorum", false, "Read ETCD v2 keys with quorum=true through the leader; v3 reads are linearizable anyway")
+	flag.BoolVar(&etcdInsecure, "etcd-insecure-skip-verify", false, "Do not verify https:// ETCD endpoint certificate, e.g. self-signed in non-production; AWS calls are still verified")
+	flag.IntVar(&maxIndex, "max-index", 100, "The upper bound of machine index, exclusive")
+	flag.IntVar(&indexWidth, "index-width", 0, "Zero-pad the index in tag and DNS names to this width, e.g. 3 for machine-007; ETCD keys and -index-tag-name are not padded")
+	flag.IntVar(&indexStart, "index-start", 1, "The lowest machine index, e.g. 0 for zero-based names")
+	flag.DurationVar(&indexTtl, "index-ttl", 0, "When greater than zero then the ETCD index key expires after TTL unless refreshed by -watch, so that slots of terminated machines are freed")
+	flag.BoolVar(&watch, "watch", false, "Keep running: re-apply instance tag and DNS record, refresh the ETCD index key TTL, and release the index on exit")
+	flag.StringVar(&healthAddr, "health-addr", "", "Serve /healthz and /readyz on this address in -watch mode, e.g. :8080")
+	flag.DurationVar(&watchInterval, "watch-interval", 5*time.Minute, "How often instance tag and DNS record are re-applied in -watch mode")
+	flag.Var(&alsoTagResources, "also-tag-resource", "Additional AWS resource id to set the instance tags on, e.g. EIP allocation or volume, may be repeated")
+	flag.BoolVar(&reclaimStale, "reclaim-stale", false, "Free other slots holding our instance id or hostname under another machine id, as left by a re-imaged host")
+	flag.BoolVar(&releaseOnExit, "release-on-exit", false, "Keep running until SIGINT or SIGTERM, then release the ETCD index and remove DNS record; implied by -watch")
+	flag.BoolVar(&deregisterOnExit, "deregister-on-exit", false, "Keep running until SIGINT or SIGTERM, then remove the instance tag and DNS record")
+	flag.StringVar(&tagName, "tag-name", "Name", "The name of the AWS tag to set")
+	flag.BoolVar(&tagVolumes, "tag-volumes", false, "Also set the tag on EBS volumes attached to the instance; aws only")
+	flag.BoolVar(&tagEni, "tag-eni", false, "Also set the instance tags on the primary network interface; aws only")
+	flag.BoolVar(&tagEniAll, "tag-eni-all", false, "Also set the instance tags on all attached network interfaces, implies -tag-eni")
+	flag.StringVar(&volumeTagTemplate, "volume-tag-template", "", "The volume tag value template for -tag-volumes, -tag-template if empty")
+	flag.StringVar(&tagTemplate, "tag-template", "{stack-}{prefix}{index}", "The tag value template, placeholders are {stack}, {stack-} (with dash if not empty), {prefix}, {index}, {az}, {region}, {instance}")
+	flag.Var(&tagExtra, "tag", "Additional instance tag as key=value, value may use -tag-template placeholders, may be repeated")
+	flag.StringVar(&stableTagName, "stable-tag-name", "", "The name of the AWS tag to also set to the -tag-name value, for a name CloudFormation does not reset; disabled if empty")
+	flag.StringVar(&indexTagName, "index-tag-name", "", "The name of the AWS tag to set to bare machine index, disabled if empty")
+	flag.StringVar(&azTagName, "az-tag-name", "", "The name of the AWS tag to set to instance availability zone, disabled if empty")
+	flag.StringVar(&regionTagName, "region-tag-name", "", "The name of the AWS tag to set to instance region, disabled if empty")
+	flag.StringVar(&tagPrefix, "tag-prefix", "machine-", "The prefix to which machine index will be appended")
+	flag.StringVar(&stackName, "stack-name", "", "The name of the stack")
+	flag.StringVar(&dnsNameTemplate, "dns-name-template", "{prefix}{index}{.stack}.{zone}", "The DNS record name template, placeholders are those of -tag-template and {zone}")
+	flag.BoolVar(&dnsPtr, "dns-ptr", false, "Also set PTR record of the A record IP pointing back to the A record name")
+	flag.StringVar(&ptrZone, "ptr-zone", "", "The Route53 reverse DNS zone for -dns-ptr, e.g. 10.in-addr.arpa")
+	flag.StringVar(&dnsZone, "dns-zone", "", "The Route53 DNS zone to insert machine A record into, comma-separated list to insert into several zones")
+	flag.BoolVar(&dnsPrivate, "dns-private", false, "Use Route53 private zone associated with the instance VPC, public zone is preferred otherwise")
+	flag.StringVar(&dnsType, "dns-type", "A", "The type of machine DNS record: A or CNAME")
+	flag.StringVar(&dnsAliasTarget, "dns-alias-target", "", "Make machine DNS record an alias to the load balancer or other AWS target given as dns-name@hosted-zone-id instead of the instance IP")
+	flag.BoolVar(&dnsAliasHealth, "dns-alias-evaluate-health", false, "Have Route53 evaluate the health of -dns-alias-target")
+	flag.BoolVar(&dnsTxt, "dns-txt", false, "Also set a TXT record with machine id, instance id, and index next to machine DNS record, or at _meta. subname of a CNAME")
+	flag.IntVar(&dnsWeight, "dns-weight", 0, "When greater than zero then machine DNS record is a weighted record with this weight, up to 255")
+	flag.StringVar(&dnsSetIdentifier, "dns-set-identifier", "", "The set identifier of weighted machine DNS record, instance id if empty")
+	flag.StringVar(&dnsTarget, "dns-target", "", "The CNAME record target, instance public or local hostname by -dns-ip-source if empty")
+	flag.Var(&dnsExtra, "dns-extra", "Additional DNS record as name=IP or name=self to use the machine record value, may be repeated")
+	flag.BoolVar(&dnsPrune, "dns-prune", false, "Delete machine A records pointing to IPs of no running instance before inserting ours")
+	flag.IntVar(&dnsTtl, "dns-ttl", 300, "The TTL of machine DNS record, in seconds")
+	flag.DurationVar(&dnsWait, "dns-wait", 0, "When greater than zero then wait up to this long for Route53 to propagate the DNS change, i.e. report it INSYNC")
+	flag.StringVar(&dnsIpSource, "dns-ip-source", "public", "The instance address to put into machine A record: public or private")
+	flag.BoolVar(&dnsIpv6, "dns-ipv6", false, "Also insert machine AAAA record if the instance has IPv6 address")
+	flag.Var((*secondsDuration)(&delay), "delay", "When greater than zero then the instance tag is set again after the delay to combat CloudFormation reseting it, e.g. 30s or 2m, bare number is seconds")
+	flag.BoolVar(&readUserData, "read-user-data", false, "Fill options not given on the command line or in -config from the cloudtag: block of the instance user-data")
+	flag.StringVar(&configFile, "config", "", "The config file with keys mirroring the flags, command-line flags take precedence")
+	flag.BoolVar(&printVersion, "version", false, "Print version and exit")
+	flag.BoolVar(&printChangeId, "print-change-id", false, "Print Route53 change ids to stdout once tag and DNS record are set, one per line")
+	flag.BoolVar(&printIndex, "print-index", false, "Print the allocated index to stdout once tag and DNS record are set")
+	flag.StringVar(&indexFile, "index-file", "", "Write the allocated index to this file, e.g. /run/cloudtag/index, and reuse it on restart if still held")
+	flag.StringVar(&indexFileFormat, "index-file-format", "plain", "The index file format: plain number, or env for CLOUDTAG_INDEX=N")
+	flag.StringVar(&envFile, "env-file", "", "The file to write CLOUDTAG_INDEX, CLOUDTAG_NAME, CLOUDTAG_FQDN, and CLOUDTAG_REGION to for systemd EnvironmentFile=, once tag and DNS record are set")
+	flag.StringVar(&hostsFile, "hosts-file", "", "The hosts file, e.g. /etc/hosts, to map the instance IP to machine name in, within a block managed by Cloudtag")
+	flag.StringVar(&machineIdPath, "machine-id-file", "", "Read machine id from this file instead of "+machineIdFile+" or "+dbusMachineIdFile)
+	flag.StringVar(&machineIdSource, "machine-id-source", "file", "The machine identity to hold the index by: file for machine-id, or instance for the instance id")
+	flag.DurationVar(&indexWait, "index-wait", 0, "When all slots are busy keep re-scanning for this long before giving up")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only show the ETCD index, instance tag, and DNS records that would be written")
+	flag.BoolVar(&verbose, "verbose", false, "Print debug if true, same as -log-level debug")
+	flag.StringVar(&logLevel, "log-level", "info", "The log level: error, warn, info, or debug")
+	flag.StringVar(&logFormat, "log-format", "text", "The log format: text or json")
+	flag.StringVar(&proxyUrl, "proxy", "", "The HTTP proxy URL for ETCD and cloud API calls instead of HTTP_PROXY and HTTPS_PROXY environment variables; instance metadata is never proxied")
+	flag.BoolVar(&identityDoc, "identity-doc", false, "Read instance id, availability zone, and region from the instance identity document in one request; aws only")
+	flag.StringVar(&metadataUrl, "metadata-url", "http://169.254.169.254/latest/meta-data/", "The instance metadata service base URL; with -cloud gcp or azure their metadata server is the default")
+	flag.IntVar(&metadataRetries, "metadata-retries", 5, "How many times to retry instance metadata requests on connection errors and 5xx replies")
+	flag.DurationVar(&metadataCacheTtl, "metadata-cache-ttl", time.Minute, "How long to reuse instance metadata values that may change, like public IP; instance id and the like are read once")
+	flag.DurationVar(&metadataRetryDelay, "metadata-retry-delay", time.Second, "Initial delay between instance metadata retries, doubled on each attempt")
+	flag.StringVar(&assumeRoleArn, "assume-role-arn", "", "Assume this IAM role for EC2 and Route53 calls, e.g. for cross-account tagging")
+	flag.StringVar(&dnsAssumeRoleArn, "dns-assume-role-arn", "", "Assume this IAM role for Route53 calls only, e.g. when the zone lives in another account")
+	flag.StringVar(&externalId, "external-id", "", "External ID to pass when assuming the role")
+	flag.StringVar(&awsEndpoint, "aws-endpoint", "", "Send EC2, Route53, and STS calls to this URL instead of AWS, e.g. http://localhost:4566 for LocalStack")
+	flag.IntVar(&awsRetries, "aws-retries", 5, "How many times to retry AWS API calls on throttling and server errors")
+	flag.DurationVar(&awsRetryDelay, "aws-retry-delay", time.Second, "Initial delay between AWS API retries, doubled on each attempt with random jitter")
+	flag.DurationVar(&timeout, "timeout", 0, "When greater than zero then exit with error if the index, tag, and DNS record are not set within the timeout")
+	flag.DurationVar(&httpTimeout, "http-timeout", 10*time.Second, "Timeout of instance metadata, ETCD, STS, DynamoDB, S3, CloudWatch, and SNS requests, including reading the reply")
+	flag.IntVar(&retagCount, "retag-count", 0, "How many times to set the instance tag again after the initial set, every -retag-interval; overrides -delay")
+	flag.DurationVar(&retagInterval, "retag-interval", 30*time.Second, "The interval between re-tags of -retag-count")
+	flag.BoolVar(&cloudwatch, "cloudwatch", false, "Publish IndexAllocated and AllocationTime CloudWatch metrics in CloudTag namespace once tag and DNS record are set; aws only")
+	flag.StringVar(&snsTopicArn, "sns-topic-arn", "", "The SNS topic to publish index, instance id, region, and FQDN to as JSON once tag and DNS record are set; aws only")
+	flag.BoolVar(&verifyTag, "verify-tag", false, "Read the instance tag back after tagging and re-tag for up to 30s until it holds our value, warn if it never does; aws only")
+	flag.StringVar(&listFormat, "format", "table", "The output format of list command: table or json")
+	flag.IntVar(&releaseIndex, "index", -1, "The index to free with release command")
+	flag.StringVar(&releaseMachineId, "machine-id", "", "The machine id to free the index of with release command; with -index the slot is freed only if held by it")
+	flag.StringVar(&imdsVersion, "imds-version", "auto", "Instance metadata service version: auto, v1, or v2; auto tries v2 token first and falls back to v1 if the token API is not available; instance role credentials are read the same way")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr,
+			`Usage: cloudtag [-etcd host[:port]] [-etcd-prefix /cloudtag] [-tag-name Name] [-tag-prefix machine-] [-stack-name coreos-1] [-dns-zone cloud.some] [-delay 0s] [-imds-version auto] [-verbose]
+    Name tag will be:     {stack-name-}{machine-}{index}, unless -tag-template is given
+    DNS A record will be: {machine-}{index}{.stack-name}{.dns-zone}
+       cloudtag release [-index N] [-machine-id ID] [-etcd host[:port]] [-etcd-prefix /cloudtag] [-tag-name Name] [-tag-prefix machine-]
+       cloudtag list [-format table] [-etcd host[:port]] [-etcd-prefix /cloudtag] [-tag-name Name] [-tag-prefix machine-]
+       cloudtag preflight [flags of the run to check]
+Typical usage:
+    $ AWS_ACCESS_KEY=... AWS_SECRET_KEY=... ./cloudtag -tag-prefix core- -stack-name deis-1 -dns-zone mycontainers.io -delay 30s
+    AWS credentials are read from
+    * environment, with AWS_SESSION_TOKEN for temporary credentials
+    * ~/.aws/credentials
+    * instance IAM role (http://169.254.169.254/latest/meta-data/iam/security-credentials/)
+Flags:
+`)
+		flag.PrintDefaults()
+	}
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "release" || args[0] == "list" || args[0] == "preflight") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if configFile != "" {
+		err := loadConfig(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func machineId() (string, error) {
+	path := machineIdPath
+	if path == "" {
+		path = machineIdFile
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			slog.Debug("machine id file not found, trying dbus", "file", path)
+			path = dbusMachineIdFile
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return "", errors.New(fmt.Sprintf("No machine id found in %s or %s, use -machine-id-file", machineIdFile, dbusMachineIdFile))
+			}
+		}
+	}
+	_id, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(_id))
+	if id == "" {
+		return "", errors.New("Empty machine id read from " + path)
+	}
+	return id, nil
+}
+
+// Finds our slot or allocates the first free one, with single ETCD request listing all index keys
+func findIndex(mid string) (index int, err error) {
+	held, err := list()
+	if err != nil {
+		return 0, err
+	}
+	if held == nil {
+		slog.Debug("index directory does not exist yet, scanning")
+		return scanIndex(mid)
+	}
+	for i := indexStart; i < maxIndex; i++ {
+		if held[i] == mid {
+			return i, nil
+		}
+	}
+	for i := indexStart; i < maxIndex; i++ {
+		if held[i] != "" {
+			slog.Debug("index taken", "index", i, "machine_id", held[i])
+			continue
+		}
+		if dryRun {
+			slog.Info("would allocate index", "index", i, "key", etcdKey(etcdPrefix, tagPrefix, tagName, i), "machine_id", mid)
+			return i, nil
+		}
+		return allocateIndex(mid, i, held)
+	}
+	return 0, fmt.Errorf("Cannot find machine index - %w, checked %d slots from %d", errSlotsBusy, maxIndex-indexStart, indexStart)
+}
+
+// Checks the slots one by one
+func scanIndex(mid string) (index int, err error) {
+	for i := indexStart; i < maxIndex; i++ {
+		maybe, err := get(i)
+		if err != nil {
+			return 0, err
+		}
+		if maybe != "" {
+			slog.Debug("index taken", "index", i, "machine_id", maybe)
+		}
+		if maybe == mid {
+			return i, nil
+		} else if maybe == "" {
+			if dryRun {
+				slog.Info("would allocate index", "index", i, "key", etcdKey(etcdPrefix, tagPrefix, tagName, i), "machine_id", mid)
+				return i, nil
+			}
+			return allocateIndex(mid, i, nil)
+		}
+	}
+	return 0, fmt.Errorf("Cannot find machine index - %w, checked %d slots from %d", errSlotsBusy, maxIndex-indexStart, indexStart)
+}
+
+// Claims the first free slot from start, skipping slots known to be held by others
+func allocateIndex(mid string, start int, held map[int]string) (index int, err error) {
+	for i := start; i < maxIndex; i++ {
+		if held[i] != "" && held[i] != mid {
+			continue
+		}
+		ok, err := claim(mid, i)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Cannot allocate machine index - %w, checked %d slots from %d", errSlotsBusy, maxIndex-indexStart, indexStart)
+}
+
+// Atomic create of the index key; when another create won, the slot is re-read as the winner
+// may be us, e.g. when the PUT was retried on another ETCD endpoint after the reply was lost
+func claim(mid string, index int) (ok bool, err error) {
+	ok, err = put(mid, index)
+	if err != nil || ok {
+		indexClaimed = ok
+		return
+	}
+	owner, err := get(index)
+	if err != nil {
+		return false, err
+	}
+	if owner == mid {
+		indexClaimed = true
+		return true, nil
+	}
+	slog.Debug("index taken meanwhile", "index", index, "machine_id", owner)
+	return false, nil
+}
+
+var errSlotsBusy = errors.New("all slots are busy")
+
+// Re-scans while all slots are busy until -index-wait is over, slots may be freed as TTLs expire
+func waitIndex(mid string) (index int, err error) {
+	deadline := time.Now().Add(indexWait)
+	for attempt := 1; ; attempt++ {
+		index, err = findIndex(mid)
+		if err == nil || !errors.Is(err, errSlotsBusy) || indexWait <= 0 {
+			return
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return 0, fmt.Errorf("%w, gave up after %d attempts in %v", err, attempt, indexWait)
+		}
+		slog.Info("all slots are busy, waiting", "attempt", attempt, "left", left)
+		err = sleep(min(indexWaitPause, left))
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+type EtcdNode struct {
+	Key   string
+	Value string
+	Dir   bool
+	Nodes []EtcdNode
+}
+
+type EtcdOp struct {
+	Action string
+	Node   EtcdNode
+}
+
+// Index key value, so that the ETCD tree tells which machine holds the slot
+type EtcdValue struct {
+	MachineId  string `json:"machine_id"`
+	Hostname   string `json:"hostname,omitempty"`
+	InstanceId string `json:"instance_id,omitempty"`
+	Updated    string `json:"updated"`
+}
+
+func etcdValue(mid string) string {
+	hostname, _ := os.Hostname()
+	value, _ := json.Marshal(&EtcdValue{MachineId: mid, Hostname: hostname, InstanceId: instanceId, Updated: time.Now().UTC().Format(time.RFC3339)})
+	return string(value)
+}
+
+// Machine id from the index key value
+func etcdOwner(value string) string {
+	return parseEtcdValue(value).MachineId
+}
+
+// Plain string value written by older versions is machine id itself
+func parseEtcdValue(value string) (v EtcdValue) {
+	if strings.HasPrefix(value, "{") && json.Unmarshal([]byte(value), &v) == nil {
+		return
+	}
+	return EtcdValue{MachineId: value}
+}
+
+// With -etcd-namespace-by-region and -etcd-namespace-by-stack the region and the stack name are extra directory levels, in that order.
+// Without the flags the layout is flat as before
+func etcdDir(etcdPrefix string, tagPrefix string, tagName string) string {
+	if etcdByRegion && etcdRegion != "" {
+		etcdPrefix = etcdPrefix + "/" + etcdRegion
+	}
+	if etcdByStack && stackName != "" {
+		etcdPrefix = etcdPrefix + "/" + stackName
+	}
+	return fmt.Sprintf("%s/%s%s", etcdPrefix, tagPrefix, tagName)
+}
+
+func etcdKey(etcdPrefix string, tagPrefix string, tagName string, index int) string {
+	return fmt.Sprintf("%s/%d", etcdDir(etcdPrefix, tagPrefix, tagName), index)
+}
+
+// Index as it appears in tag and DNS names
+func formatIndex(index int) string {
+	return fmt.Sprintf("%0*d", indexWidth, index)
+}
+
+// Index from the last component of the key, -1 if the key is not an index key
+func etcdKeyIndex(key string) int {
+	index, err := strconv.Atoi(key[strings.LastIndex(key, "/")+1:])
+	if err != nil || index < 0 {
+		return -1
+	}
+	return index
+}
+
+func etcdEndpoint(etcdAddress string) string {
+	if strings.Contains(etcdAddress, "://") {
+		return etcdAddress
+	}
+	return etcdScheme + "://" + etcdAddress
+}
+
+func etcdPath(etcdPrefix string, tagPrefix string, tagName string, index int) string {
+	return "/v2/keys" + etcdKey(etcdPrefix, tagPrefix, tagName, index)
+}
+
+func newEtcdClient() (*http.Client, error) {
+	secure := false
+	for _, endpoint := range etcdEndpoints {
+		secure = secure || strings.HasPrefix(endpoint, "https://")
+	}
+	if !secure {
+		return manualRedirects(httpClient), nil
+	}
+	config := &tls.Config{}
+	if etcdInsecure {
+		slog.Warn("ETCD TLS certificate verification is disabled by -etcd-insecure-skip-verify")
+		config.InsecureSkipVerify = true
+	}
+	if etcdCaFile != "" {
+		pem, err := ioutil.ReadFile(etcdCaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No ETCD CA certificates found in " + etcdCaFile)
+		}
+	}
+	if etcdCertFile != "" || etcdKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(etcdCertFile, etcdKeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot load ETCD client certificate `%s` and key `%s`: %v", etcdCertFile, etcdKeyFile, err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return manualRedirects(&http.Client{Timeout: httpTimeout, Transport: transport}), nil
+}
+
+// Copy of the client that hands 307 replies back to etcdSend, instead of following them with the scheme the leader advertises
+func manualRedirects(client *http.Client) *http.Client {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &c
+}
+
+func etcdRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if etcdUser != "" {
+		req.SetBasicAuth(etcdUser, etcdPassword)
+	}
+	return req, nil
+}
+
+// ETCD v2 keys API
+type etcd2Store struct {
+	dirReady bool // the index directory is created before the first key
+}
+
+// With -etcd-quorum reads go through the leader, so that a lagging follower does not show a taken slot as free
+func etcdQuorumParam(sep string) string {
+	if !etcdQuorum {
+		return ""
+	}
+	return sep + "quorum=true"
+}
+
+func (s *etcd2Store) List() (values map[int]string, err error) {
+	res, err := etcdDo("GET", "/v2/keys"+etcdDir(etcdPrefix, tagPrefix, tagName)+"?recursive=true"+etcdQuorumParam("&"), "", "")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v", res))
+	}
+	s.dirReady = true
+	bin, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	slog.Debug("got", "body", string(bin))
+	var j EtcdOp
+	err = json.Unmarshal(bin, &j)
+	if err != nil {
+		return
+	}
+	values = make(map[int]string)
+	for _, node := range j.Node.Nodes {
+		if index := etcdKeyIndex(node.Key); index >= 0 && !node.Dir {
+			values[index] = node.Value
+		}
+	}
+	return values, nil
+}
+
+func (s *etcd2Store) Get(index int) (value string, err error) {
+	res, err := etcdDo("GET", etcdPath(etcdPrefix, tagPrefix, tagName, index)+etcdQuorumParam("?"), "", "")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v", res))
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	slog.Debug("got", "body", string(bin))
+	var j EtcdOp
+	err = json.Unmarshal(bin, &j)
+	if err != nil {
+		return
+	}
+	slog.Debug("parsed", "json", fmt.Sprintf("%+v", j))
+	return j.Node.Value, nil
+}
+
+func (s *etcd2Store) CreateIfAbsent(index int, value string) (ok bool, err error) {
+	if !s.dirReady {
+		err = s.createDir()
+		if err != nil {
+			return
+		}
+		s.dirReady = true
+	}
+	params := url.Values{}
+	params.Set("prevExist", "false")
+	if indexTtl > 0 {
+		params.Set("ttl", strconv.Itoa(int(indexTtl/time.Second)))
+	}
+	path := etcdPath(etcdPrefix, tagPrefix, tagName, index) + "?" + params.Encode()
+	// the JSON value has quotes, colons, and the like, form encoding keeps it intact
+	form := url.Values{}
+	form.Set("value", value)
+	res, err := etcdDo("PUT", path, "application/x-www-form-urlencoded", form.Encode())
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusCreated {
+		return false, errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v", res))
+	}
+	return true, nil
+}
+
+// Creating a key in a missing directory creates the directory too, but a fresh cluster
+// may fail that in surprising ways; existing directory is fine
+func (s *etcd2Store) createDir() error {
+	res, err := etcdDo("PUT", "/v2/keys"+etcdDir(etcdPrefix, tagPrefix, tagName)+"?dir=true&prevExist=false", "application/x-www-form-urlencoded", "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusCreated {
+		slog.Debug("created ETCD directory", "dir", etcdDir(etcdPrefix, tagPrefix, tagName))
+		return nil
+	}
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Cannot create ETCD directory %s, ETCD reply %+v", etcdDir(etcdPrefix, tagPrefix, tagName), res))
+}
+
+func (s *etcd2Store) Refresh(index int, value string) error {
+	params := url.Values{}
+	params.Set("ttl", strconv.Itoa(int(indexTtl/time.Second)))
+	params.Set("refresh", "true")
+	params.Set("prevExist", "true")
+	params.Set("prevValue", value)
+	path := etcdPath(etcdPrefix, tagPrefix, tagName, index) + "?" + params.Encode()
+	res, err := etcdDo("PUT", path, "application/x-www-form-urlencoded", "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Cannot refresh TTL of machine index %d, ETCD reply %+v", index, res))
+	}
+	return nil
+}
+
+func (s *etcd2Store) Delete(index int, prevValue string) (ok bool, err error) {
+	params := url.Values{}
+	params.Set("prevValue", prevValue)
+	path := etcdPath(etcdPrefix, tagPrefix, tagName, index) + "?" + params.Encode()
+	res, err := etcdDo("DELETE", path, "", "")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed || res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v", res))
+	}
+	return true, nil
+}
+
+// Sends the request to ETCD endpoints in turn, starting with the last one that worked,
+// until one replies. Connection errors and 5xx replies are not answers, try next endpoint.
+// Retries with jittered backoff for up to -etcd-retry-timeout while all endpoints fail, e.g. during leader election
+func etcdDo(method string, path string, contentType string, body string) (res *http.Response, err error) {
+	start := time.Now()
+	wait := etcdRetryDelay
+	for {
+		res, err = etcdFailover(method, path, contentType, body)
+		if err == nil && !etcdRetryable(res.StatusCode) {
+			return
+		}
+		delay := jitter(wait)
+		if time.Since(start)+delay > etcdRetryTimeout {
+			if err == nil {
+				res.Body.Close()
+				return nil, errors.New(fmt.Sprintf("ETCD %s %s failed with %d %s after %v", method, path, res.StatusCode, http.StatusText(res.StatusCode), time.Since(start).Round(time.Millisecond)))
+			}
+			return
+		}
+		status := ""
+		if err == nil {
+			status = res.Status
+			res.Body.Close()
+		}
+		slog.Warn("ETCD unavailable, retrying", "status", status, "error", err, "delay", delay)
+		err = sleep(delay)
+		if err != nil {
+			return nil, err
+		}
+		wait *= 2
+	}
+}
+
+// 503 during leader loss, 429 when the member is overloaded
+func etcdRetryable(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// Tries the endpoints in turn starting with the last good one
+func etcdFailover(method string, path string, contentType string, body string) (res *http.Response, err error) {
+	for i := range etcdEndpoints {
+		e := (etcdCurrent + i) % len(etcdEndpoints)
+		res, err = etcdSend(method, etcdEndpoints[e]+path, contentType, body)
+		if err == nil && !etcdRetryable(res.StatusCode) {
+			etcdCurrent = e
+			return
+		}
+		if i == len(etcdEndpoints)-1 {
+			return
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+		slog.Warn("ETCD endpoint failed, trying next one", "endpoint", etcdEndpoints[e])
+	}
+	return
+}
+
+func etcdSend(method string, url string, contentType string, body string) (res *http.Response, err error) {
+	slog.Debug("ETCD request", "method", method, "url", url)
+	send := true
+	redirects := 0
+	for send {
+		if redirects > 0 && maxEtcdRedirects == 0 {
+			return nil, errors.New(fmt.Sprintf("ETCD redirected to %v, but following redirects is disabled", url))
+		}
+		if redirects > maxEtcdRedirects {
+			return nil, errors.New(fmt.Sprintf("Too much redirects (%d) from ETCD while requesting %v", maxEtcdRedirects, url))
+		}
+		req, err := etcdRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		slog.Debug("sending", "method", req.Method, "url", req.URL.Redacted())
+		res, err = etcdClient.Do(req)
+		slog.Debug("got", "response", fmt.Sprintf("%+v", res), "error", err)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusTemporaryRedirect {
+			res.Body.Close()
+			masterUrl, err := res.Location()
+			if err != nil {
+				return nil, err
+			}
+			masterUrl.Scheme = req.URL.Scheme
+			url = masterUrl.String()
+			redirects++
+			// first redirect is to the leader, more mean the cluster is electing one
+			if redirects > 1 {
+				err = sleep(jitter(etcdRetryDelay << (redirects - 2)))
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			send = false
+		}
+	}
+	return
+}
+
+var (
+	metadataToken        string
+	metadataTokenFetched bool
+	metadataTokenExpires time.Time // renewed a minute before, -watch runs longer than the token lives
 )
 
-func main() {
-	/*
-	  parse args
-	  read /etc/machine-id
-	  connect etcd
-	  find or grab an index under etcd /prefix and write machine-id into it
-	  determine aws region and instance-id from metadata
-	  connect aws (using IAM role granted to instance)
-	  tag instance as {prefix}{index}
-	  write A record {prefix}{index} into R53 zone
-	*/
-	parseFlags()
-	if !strings.HasPrefix(etcdPrefix, "/") {
-		log.Fatal("etcd-prefix must start with `/`, got `%s`", etcdPrefix)
+// IMDSv2 session token, empty if IMDSv1 is to be used. In auto mode only a reply telling that
+// the token API is not there falls back to IMDSv1, a 5xx is retried
+func imdsToken() (token string, retry bool, err error) {
+	if imdsVersion == "v1" || metadataTokenFetched && (metadataToken == "" || time.Now().Before(metadataTokenExpires)) {
+		return metadataToken, false, nil
 	}
-	if dnsZone != "" && !strings.HasSuffix(dnsZone, ".") {
-		dnsZone = dnsZone + "."
+	base, err := url.Parse(metadataUrl)
+	if err != nil {
+		return
 	}
-
-	mid, err := machineId()
+	tokenUrl := base.ResolveReference(&url.URL{Path: "../api/token"})
+	req, err := http.NewRequestWithContext(ctx, "PUT", tokenUrl.String(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
-
-	index, err := findIndex(mid)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(metadataTokenTTL))
+	res, err := metadataClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return "", true, err
 	}
-
-	publicIp, err := metadata("public-ipv4")
+	bin, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
 	if err != nil {
-		log.Fatal(err)
+		return "", true, err
+	}
+	switch {
+	case res.StatusCode == http.StatusOK:
+		metadataToken = strings.TrimSpace(string(bin))
+		metadataTokenExpires = time.Now().Add(metadataTokenTTL*time.Second - time.Minute)
+	case imdsVersion == "auto" && (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed):
+		slog.Debug("IMDSv2 token API is not available, falling back to IMDSv1", "status", res.Status)
+	default:
+		return "", res.StatusCode >= 500, errors.New(fmt.Sprintf("Cannot obtain IMDSv2 token, got %v", res.Status))
+	}
+	metadataTokenFetched = true
+	return metadataToken, false, nil
+}
+
+type cachedMetadata struct {
+	value   string
+	expires time.Time // zero for values that never change
+}
+
+var (
+	metadataCache     = make(map[string]cachedMetadata)
+	metadataCacheLock sync.Mutex
+)
+
+// Instance metadata that does not change during the instance lifetime
+func metadataImmutable(what string) bool {
+	switch what {
+	case "instance-id", "placement/availability-zone", "mac", "../dynamic/instance-identity/document":
+		return true
+	}
+	return strings.HasPrefix(what, "network/interfaces/macs/") && strings.HasSuffix(what, "/vpc-id")
+}
+
+var errMetadataNotFound = errors.New("Instance metadata not found")
+
+// Value of the metadata that some instances do not have, found is false on 404 or empty value
+func metadataOptional(what string) (value string, found bool, err error) {
+	value, err = metadata(what)
+	if errors.Is(err, errMetadataNotFound) {
+		slog.Debug("no instance metadata", "path", what)
+		return "", false, nil
 	}
-	instance, err := metadata("instance-id")
 	if err != nil {
-		log.Fatal(err)
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Cached for -metadata-cache-ttl, or for good if the value never changes
+func metadata(what string) (value string, err error) {
+	metadataCacheLock.Lock()
+	cached, ok := metadataCache[what]
+	metadataCacheLock.Unlock()
+	if ok && (cached.expires.IsZero() || time.Now().Before(cached.expires)) {
+		return cached.value, nil
 	}
-	availabilityZone, err := metadata("placement/availability-zone")
+	value, err = metadataRetry(what, metadataOnce)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
-	region := availabilityZone[0 : len(availabilityZone)-1]
+	if metadataImmutable(what) {
+		cached = cachedMetadata{value: value}
+	} else if metadataCacheTtl > 0 {
+		cached = cachedMetadata{value: value, expires: time.Now().Add(metadataCacheTtl)}
+	} else {
+		return
+	}
+	metadataCacheLock.Lock()
+	metadataCache[what] = cached
+	metadataCacheLock.Unlock()
+	return
+}
 
-	if verbose {
-		log.Printf("machine id = %v", mid)
-		log.Printf("index = %d", index)
-		log.Printf("region = %v", region)
-		log.Printf("tag = %v", tagName)
-		log.Printf("prefix = %v", tagPrefix)
-		log.Printf("stack = %v", stackName)
-		log.Printf("dns zone = %v", dnsZone)
+// Retries once() up to -metadata-retries while it says so, shared by the metadata services of all clouds
+func metadataRetry(what string, once func(what string) (value string, retry bool, err error)) (value string, err error) {
+	wait := metadataRetryDelay
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		value, retry, err = once(what)
+		if !retry || attempt >= metadataRetries {
+			return
+		}
+		slog.Debug("metadata request failed, retrying", "path", what, "error", err, "attempt", attempt+1, "retries", metadataRetries, "wait", wait)
+		err = sleep(wait)
+		if err != nil {
+			return "", err
+		}
+		wait *= 2
 	}
+}
 
-	auth, err := aws.GetAuth("", "")
+func metadataOnce(what string) (value string, retry bool, err error) {
+	token, retry, err := imdsToken()
 	if err != nil {
-		log.Fatal(err)
+		return "", retry, err
 	}
-	_region := aws.Regions[region]
-	if dnsZone != "" {
-		dns(r53.New(auth, _region), publicIp, index)
+	location := metadataUrl + what
+	if strings.HasPrefix(what, "../") {
+		// outside of meta-data/, e.g. dynamic/
+		base, err := url.Parse(metadataUrl)
+		if err != nil {
+			return "", false, err
+		}
+		location = base.ResolveReference(&url.URL{Path: what}).String()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	res, err := metadataClient.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", true, err
+	}
+	if res.StatusCode != http.StatusOK {
+		err = errors.New(fmt.Sprintf("Cannot read instance metadata %v, got %v", what, res.Status))
+		if res.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", errMetadataNotFound, err)
+		}
+		return "", res.StatusCode >= 500, err
+	}
+	value = strings.TrimSpace(string(bin))
+	if strings.HasPrefix(what, "iam/security-credentials/") && what != "iam/security-credentials/" {
+		slog.Debug("metadata", "path", what)
+	} else {
+		slog.Debug("metadata", "path", what, "value", value)
 	}
-	if tagName != "" {
-		tag(ec2.New(auth, _region), instance, index)
+	if value == "" {
+		return "", false, fmt.Errorf("%w: empty instance metadata %v", errMetadataNotFound, what)
 	}
+	return
 }
 
-func parseFlags() {
-	flag.StringVar(&etcdAddress, "etcd", "localhost:4001", "The ETCD endpoint")
-	flag.StringVar(&etcdPrefix, "etcd-prefix", "/cloudtag", "The directory in ETCD to use for machine index allocation")
-	flag.StringVar(&tagName, "tag-name", "Name", "The name of the AWS tag to set")
-	flag.StringVar(&tagPrefix, "tag-prefix", "machine-", "The prefix to which machine index will be appended")
-	flag.StringVar(&stackName, "stack-name", "", "The name of the stack")
-	flag.StringVar(&dnsZone, "dns-zone", "", "The Route53 DNS zone to insert machine A record into")
-	flag.IntVar(&delay, "delay", 0, "When greater than zero then the instance tag is set again after the delay to combat CloudFormation reseting it")
-	flag.BoolVar(&verbose, "verbose", false, "Print debug if true")
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr,
-			`Usage: cloudtag [-etcd host[:port]] [-etcd-prefix /cloudtag] [-tag-name Name] [-tag-prefix machine-] [-stack-name coreos-1] [-dns-zone cloud.some] [-delay 0] [-verbose]
-    Name tag will be:     {stack-name-}{machine-}{index}
-    DNS A record will be: {machine-}{index}{.stack-name}{.dns-zone}
-Typical usage:
-    $ AWS_ACCESS_KEY=... AWS_SECRET_KEY=... ./cloudtag -tag-prefix core- -stack-name deis-1 -dns-zone mycontainers.io -delay 30
-    AWS credentials are read from
-    * environment
-    * ~/.aws/credentials
-    * instance IAM role (http://169.254.169.254/latest/meta-data/iam/security-credentials/)
-Flags:
-`)
-		flag.PrintDefaults()
+func vpc() (string, error) {
+	mac, err := metadata("mac")
+	if err != nil {
+		return "", err
+	}
+	vpcId, found, err := metadataOptional("network/interfaces/macs/" + mac + "/vpc-id")
+	if err == nil && !found {
+		return "", errors.New("The instance is not in a VPC, -dns-private requires one")
 	}
-	flag.Parse()
+	return vpcId, err
 }
 
-func machineId() (string, error) {
-	_id, err := ioutil.ReadFile(machineIdFile)
+func ipv6() (ips []string, err error) {
+	mac, err := metadata("mac")
 	if err != nil {
-		return "", err
+		return
 	}
-	id := strings.TrimSpace(string(_id))
-	if id == "" {
-		return "", errors.New("Empty machine id read from " + machineIdFile)
+	value, found, err := metadataOptional("network/interfaces/macs/" + mac + "/ipv6s")
+	if err != nil {
+		return
 	}
-	return id, nil
+	if !found {
+		slog.Debug("no IPv6 address, skipping AAAA record")
+		return nil, nil
+	}
+	return strings.Fields(value), nil
 }
 
-func findIndex(mid string) (index int, err error) {
-	for i := 1; i < maxMachineIndex; i++ {
-		maybe, err := get(i)
+func tagValue(m *Machine) (string, error) {
+	return renderName(tagTmpl, m)
+}
+
+func tagging() bool {
+	return tagName != "" || stableTagName != "" || indexTagName != "" || azTagName != "" || regionTagName != "" || len(tagExtra) > 0
+}
+
+// The -tag-name and -stable-tag-name tags merged with index, placement, and -tag extras, set in one call
+func instanceTags(m *Machine) ([]ec2.Tag, error) {
+	var tags []ec2.Tag
+	if tagName != "" || stableTagName != "" {
+		value, err := tagValue(m)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		if verbose && maybe != "" {
-			log.Printf("index %d -> %v", i, maybe)
+		if tagName != "" {
+			tags = append(tags, ec2.Tag{Key: tagName, Value: value})
 		}
-		if maybe == mid {
-			return i, nil
-		} else if maybe == "" {
-			return allocateIndex(mid, i)
+		if stableTagName != "" {
+			tags = append(tags, ec2.Tag{Key: stableTagName, Value: value})
+		}
+	}
+	if indexTagName != "" {
+		tags = append(tags, ec2.Tag{Key: indexTagName, Value: strconv.Itoa(m.Index)})
+	}
+	if azTagName != "" {
+		tags = append(tags, ec2.Tag{Key: azTagName, Value: m.Zone})
+	}
+	if regionTagName != "" {
+		tags = append(tags, ec2.Tag{Key: regionTagName, Value: m.Region})
+	}
+	for i, key := range tagExtraKey {
+		value, err := renderName(tagExtraTmpl[i], m)
+		if err != nil {
+			return nil, err
 		}
+		tags = append(tags, ec2.Tag{Key: key, Value: value})
 	}
-	return 0, errors.New(fmt.Sprintf("Cannot find machine index - all slots are busy, checked %d slots", maxMachineIndex))
+	return tags, nil
 }
 
-func allocateIndex(mid string, start int) (index int, err error) {
-	for i := start; i < maxMachineIndex; i++ {
-		ok, err := put(mid, i)
+func tag(cloud Cloud, m *Machine) error {
+	err := cloud.Tag(m)
+	if err != nil {
+		return err
+	}
+	// -delay is a shorthand for single re-tag
+	count, interval := retagCount, retagInterval
+	if count == 0 && delay > 0 {
+		count, interval = 1, delay
+	}
+	for i := 1; i <= count; i++ {
+		slog.Debug("sleeping before re-tagging", "delay", interval, "retag", i, "count", count)
+		err = sleep(interval)
 		if err != nil {
-			return 0, err
+			return err
 		}
-		if ok {
-			return i, nil
+		err = cloud.Tag(m)
+		if err != nil {
+			return err
+		}
+	}
+	if tagVolumes {
+		err = cloud.(*awsCloud).TagVolumes(m)
+		if err != nil {
+			return err
+		}
+	}
+	if tagEni || tagEniAll {
+		err = cloud.(*awsCloud).TagEnis(m, tagEniAll)
+		if err != nil {
+			return err
 		}
 	}
-	return 0, errors.New(fmt.Sprintf("Cannot allocate machine index - all slots are busy, checked %d slots", maxMachineIndex))
+	if verifyTag && tagName != "" {
+		return cloud.(*awsCloud).VerifyTag(m)
+	}
+	return nil
 }
 
-type EtcdNode struct {
-	Key   string
-	Value string
+// Changes the records in every zone, failure in one zone does not stop the others;
+// the error is returned when all zones failed
+// Returns Route53 change ids of the successful changes
+func changeDns(r53c *r53.Route53, action string, m *Machine) (changeIds []string, err error) {
+	var failed []error
+	for _, zone := range dnsZones {
+		id, err := changeZone(r53c, action, zone, m)
+		if err != nil {
+			failed = append(failed, err)
+		} else {
+			changeIds = append(changeIds, id)
+		}
+		if len(dnsZones) > 1 {
+			if err != nil {
+				slog.Warn("Cannot change DNS records", "action", action, "zone", zone, "error", err)
+			} else {
+				slog.Info("changed DNS records", "action", action, "zone", zone)
+			}
+		}
+	}
+	if len(failed) == len(dnsZones) {
+		return nil, errors.Join(failed...)
+	}
+	if !dnsPtr {
+		return changeIds, nil
+	}
+	id, err := changePtr(r53c, action, m)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		changeIds = append(changeIds, id)
+	}
+	return changeIds, nil
 }
 
-type EtcdOp struct {
-	Action string
-	Node   EtcdNode
+func changeZone(r53c *r53.Route53, action string, zone string, m *Machine) (changeId string, err error) {
+	zoneId, err := dnsZoneId(r53c, zone, m.Vpc)
+	if err != nil {
+		return
+	}
+	records, err := dnsRecords(m, zone)
+	if err != nil {
+		return
+	}
+	var changes []r53.Change
+	for _, record := range records {
+		changes = append(changes, r53.Change{Action: action, Record: record})
+	}
+	return changeRecords(r53c, zoneId, &r53.ChangeResourceRecordSetsRequest{Changes: changes})
 }
 
-func etcdUrl(etcdAddress string, etcdPrefix string, tagPrefix string, tagName string, index int) string {
-	return fmt.Sprintf("http://%s/v2/keys%s/%s%s/%d", etcdAddress, etcdPrefix, tagPrefix, tagName, index)
+// Submits the change and, with -dns-wait, polls it until Route53 reports INSYNC
+func changeRecords(r53c *r53.Route53, zoneId string, req *r53.ChangeResourceRecordSetsRequest) (changeId string, err error) {
+	var res *r53.ChangeResourceRecordSetsResponse
+	err = awsRetry(func() (err error) {
+		res, err = r53c.ChangeResourceRecordSets(zoneId, req)
+		return
+	})
+	if err != nil {
+		return
+	}
+	id := strings.TrimPrefix(res.ChangeInfo.ID, "/change/")
+	slog.Debug("submitted DNS change", "zone", zoneId, "change", id, "status", res.ChangeInfo.Status)
+	if dnsWait <= 0 {
+		return id, nil
+	}
+	start := time.Now()
+	for status := res.ChangeInfo.Status; status != "INSYNC"; {
+		left := dnsWait - time.Since(start)
+		if left <= 0 {
+			return "", errors.New(fmt.Sprintf("DNS change %s is still %s after %v", id, status, dnsWait))
+		}
+		err = sleep(min(dnsWaitPause, left))
+		if err != nil {
+			return "", err
+		}
+		err = awsRetry(func() (err error) {
+			status, err = r53c.GetChange(id)
+			return
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	slog.Info("DNS change is in sync", "change", id, "waited", time.Since(start).Round(time.Millisecond))
+	return id, nil
 }
 
-func get(index int) (id string, err error) {
-	url := etcdUrl(etcdAddress, etcdPrefix, tagPrefix, tagName, index)
-	if verbose {
-		log.Printf("getting %v", url)
+// Reverse record of the A record IP, skipped if the reverse zone is not found
+func changePtr(r53c *r53.Route53, action string, m *Machine) (changeId string, err error) {
+	name, err := ptrName(m.Ip)
+	if err != nil {
+		return
 	}
-	res, err := http.Get(url)
-	if verbose {
-		log.Printf("got %+v %v", res, err)
+	if !strings.HasSuffix(name, "."+ptrZone) {
+		return "", errors.New(fmt.Sprintf("PTR record %s does not belong to ptr-zone %s", name, ptrZone))
 	}
+	zoneId, err := findZoneId(r53c, ptrZone, m.Vpc)
 	if err != nil {
 		return
 	}
-	if res.StatusCode == http.StatusNotFound {
+	if zoneId == "" {
+		slog.Warn("Reverse DNS zone not found, skipping PTR record", "zone", ptrZone)
 		return "", nil
 	}
-	if res.StatusCode != http.StatusOK {
-		return "", errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v", res))
-	}
-	bin, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+	target, err := dnsName(m, dnsZones[0])
 	if err != nil {
 		return
 	}
-	if verbose {
-		log.Printf("body %s", bin)
+	record := r53.ResourceRecordSet{Name: name, Type: "PTR", TTL: dnsTtl, Records: []string{target}}
+	return changeRecords(r53c, zoneId, &r53.ChangeResourceRecordSetsRequest{Changes: []r53.Change{r53.Change{Action: action, Record: record}}})
+}
+
+func ptrName(ip string) (string, error) {
+	v4 := net.ParseIP(ip).To4()
+	if v4 == nil {
+		return "", errors.New(fmt.Sprintf("Cannot make PTR record for %s, not an IPv4 address", ip))
 	}
-	var j EtcdOp
-	err = json.Unmarshal(bin, &j)
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0]), nil
+}
+
+func dnsZoneId(r53c *r53.Route53, zone string, vpcId string) (zoneId string, err error) {
+	if zoneId, ok := dnsZoneIds[zone]; ok {
+		return zoneId, nil
+	}
+	zoneId, err = findZoneId(r53c, zone, vpcId)
 	if err != nil {
 		return
 	}
-	if verbose {
-		log.Printf("json %+v", j)
+	if zoneId == "" {
+		slog.Warn("Cannot determine DNS zone ID, trying zone name as ID", "zone", zone)
+		zoneId = zone
 	}
-	return j.Node.Value, nil
+	if dnsZoneIds == nil {
+		dnsZoneIds = make(map[string]string)
+	}
+	dnsZoneIds[zone] = zoneId
+	return zoneId, nil
 }
 
-func put(mid string, index int) (ok bool, err error) {
-	url := etcdUrl(etcdAddress, etcdPrefix, tagPrefix, tagName, index) + "?prevExist=false"
-	if verbose {
-		log.Printf("putting %v", url)
+// ID of the zone by name, public or private as per -dns-private, empty if there is no zone with such name
+func findZoneId(r53c *r53.Route53, name string, vpcId string) (zoneId string, err error) {
+	matching, err := zonesNamed(name, func(marker string) (res *r53.ListHostedZonesResponse, err error) {
+		err = awsRetry(func() (err error) {
+			res, err = r53c.ListHostedZones(marker, 0)
+			return
+		})
+		return
+	})
+	if err != nil {
+		return "", err
 	}
-	put := true
-	redirects := 0
-	var res *http.Response
-	for put {
-		if redirects > maxEtcdRedirects {
-			return false, errors.New(fmt.Sprintf("Too much redirects (%d) from ETCD while creating key %v", maxEtcdRedirects, url))
-		}
-		req, err := http.NewRequest("PUT", url, strings.NewReader("value="+mid))
+	if len(matching) == 0 {
+		return "", nil
+	}
+	if len(matching) == 1 && !dnsPrivate {
+		return matching[0].ID, nil
+	}
+	// public and private zones may share the name
+	for _, zone := range matching {
+		details, err := hostedZone(r53c, zone.ID)
 		if err != nil {
-			return false, err
+			return "", err
 		}
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		if verbose {
-			log.Printf("sending %+v", req)
+		slog.Debug("zone details", "id", zone.ID, "private", details.PrivateZone, "vpcs", details.VPCs)
+		if !dnsPrivate && !details.PrivateZone {
+			return zone.ID, nil
 		}
-		res, err = http.DefaultClient.Do(req)
-		if verbose {
-			log.Printf("got %+v %v", res, err)
+		if dnsPrivate && details.PrivateZone {
+			for _, vpc := range details.VPCs {
+				if vpc == vpcId {
+					return zone.ID, nil
+				}
+			}
 		}
+	}
+	if dnsPrivate {
+		return "", errors.New(fmt.Sprintf("No Route53 private zone %s associated with VPC %s", name, vpcId))
+	}
+	return "", errors.New(fmt.Sprintf("No Route53 public zone %s", name))
+}
+
+// Zones with the name from all pages of the listing
+func zonesNamed(name string, list func(marker string) (*r53.ListHostedZonesResponse, error)) (matching []r53.HostedZone, err error) {
+	marker := ""
+	for {
+		res, err := list(marker)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		if res.StatusCode == http.StatusTemporaryRedirect {
-			masterUrl, err := res.Location()
-			if err != nil {
-				return false, err
+		for _, zone := range res.HostedZones {
+			slog.Debug("zone", "name", zone.Name, "id", zone.ID)
+			if zone.Name == name {
+				matching = append(matching, zone)
 			}
-			url = masterUrl.String()
-			redirects++
-		} else {
-			put = false
 		}
+		if !res.IsTruncated {
+			return matching, nil
+		}
+		marker = res.NextMarker
 	}
-	if res.StatusCode == http.StatusPreconditionFailed {
-		return false, nil
-	}
-	if res.StatusCode != http.StatusCreated {
-		return false, errors.New(fmt.Sprintf("Don't know how to handle ETCD reply %+v", res))
-	}
-	return true, nil
 }
 
-func metadata(what string) (value string, err error) {
-	res, err := http.Get("http://169.254.169.254/latest/meta-data/" + what)
-	if err != nil {
+type HostedZoneDetails struct {
+	PrivateZone bool     `xml:"HostedZone>Config>PrivateZone"`
+	VPCs        []string `xml:"VPCs>VPC>VPCId"`
+}
+
+func hostedZone(r53c *r53.Route53, zoneId string) (details HostedZoneDetails, err error) {
+	url := fmt.Sprintf("%s/2013-04-01/hostedzone/%s", r53c.Route53Endpoint, strings.TrimPrefix(zoneId, "/hostedzone/"))
+	var bin []byte
+	err = awsRetry(func() (err error) {
+		bin, err = awsCall(r53c.Auth, aws.Regions["us-east-1"], "route53", "GET", url, "", "")
 		return
-	}
-	bin, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+	})
 	if err != nil {
 		return
 	}
-	value = strings.TrimSpace(string(bin))
-	if verbose {
-		log.Printf("metadata %v -> %v", what, value)
-	}
-	if value == "" {
-		return "", errors.New(fmt.Sprintf("Empty instance metadata %v", what))
-	}
+	err = xml.Unmarshal(bin, &details)
 	return
 }
 
-func tag(ec2c *ec2.EC2, instance string, index int) {
-	var _stack string
-	if stackName != "" {
-		_stack = stackName + "-"
-	}
-	value := fmt.Sprintf("%s%s%d", _stack, tagPrefix, index)
-	instances := []string{instance}
-	tags := []ec2.Tag{ec2.Tag{Key: tagName, Value: value}}
-	change := func() {
-		_, err := ec2c.CreateTags(instances, tags)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	change()
-	if delay > 0 {
-		if verbose {
-			log.Printf("sleeping for %d seconds", delay)
+// Name of the machine record, -dns-name-template rendered for the zone
+func dnsName(m *Machine, zone string) (string, error) {
+	values := templateValues(m)
+	values["zone"] = zone
+	return render(dnsNameTmpl, values)
+}
+
+// The longest of -dns-zone zones the name belongs to, empty if none
+func recordZone(name string) (zone string) {
+	for _, z := range dnsZones {
+		if strings.HasSuffix(name, "."+z) && len(z) > len(zone) {
+			zone = z
 		}
-		time.Sleep(time.Duration(int64(delay) * 1000000000))
-		change()
 	}
+	return
 }
 
-func dns(r53c *r53.Route53, publicIp string, index int) {
-	res, err := r53c.ListHostedZones("", 0)
+// Records of the zone, -dns-extra records go to the zone they belong to
+func dnsRecords(m *Machine, zone string) ([]r53.ResourceRecordSet, error) {
+	record, err := dnsName(m, zone)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	var zoneId string
-	for _, zone := range res.HostedZones { // hope the response is not truncated
-		if verbose {
-			log.Printf("zone %v -> %v", zone.Name, zone.ID)
-		}
-		if zone.Name == dnsZone {
-			zoneId = zone.ID
-			break
+	if dnsType == "CNAME" && record == zone {
+		return nil, errors.New(fmt.Sprintf("Cannot create CNAME at the zone apex %s, use A record instead", zone))
+	}
+	self := r53.ResourceRecordSet{Name: record, Type: dnsType, TTL: dnsTtl, Records: []string{m.Ip}}
+	if dnsAlias != nil {
+		// alias records have no TTL nor values
+		self = r53.ResourceRecordSet{Name: record, Type: "A", AliasTarget: dnsAlias}
+	}
+	records := []r53.ResourceRecordSet{self}
+	if len(m.Ipv6) > 0 {
+		records = append(records, r53.ResourceRecordSet{Name: record, Type: "AAAA", TTL: dnsTtl, Records: m.Ipv6})
+	}
+	if dnsTxt {
+		name := record
+		if dnsType == "CNAME" {
+			// no other records may share the name with CNAME
+			name = "_meta." + record
 		}
+		txt := txtValue(fmt.Sprintf("machine_id=%s", m.Id), fmt.Sprintf("instance_id=%s", m.Instance), fmt.Sprintf("index=%d", m.Index))
+		records = append(records, r53.ResourceRecordSet{Name: name, Type: "TXT", TTL: dnsTtl, Records: []string{txt}})
 	}
-	if zoneId == "" {
-		log.Printf("Cannot determine DNS zone ID of %s, trying '%[1]s' as ID", dnsZone)
-		zoneId = dnsZone
+	if dnsWeight > 0 {
+		// goamz omits zero weight, hence no way to take a machine out of rotation with weight 0
+		id := dnsSetIdentifier
+		if id == "" {
+			id = m.Instance
+		}
+		for i := range records {
+			records[i].Weight = dnsWeight
+			records[i].SetIdentifier = id
+		}
+		self = records[0]
 	}
-	var _stack string
-	if stackName != "" {
-		_stack = "." + stackName
+	for _, extra := range dnsExtra {
+		parts := strings.SplitN(extra, "=", 2)
+		name, extraValue := parts[0], parts[1]
+		if recordZone(name) != zone {
+			continue
+		}
+		if extraValue == "self" {
+			self.Name = name
+			records = append(records, self)
+			continue
+		}
+		extraType := "AAAA"
+		if net.ParseIP(extraValue).To4() != nil {
+			extraType = "A"
+		}
+		records = append(records, r53.ResourceRecordSet{Name: name, Type: extraType, TTL: dnsTtl, Records: []string{extraValue}})
 	}
-	record := fmt.Sprintf("%s%d%s.%s", tagPrefix, index, _stack, dnsZone)
-	req := &r53.ChangeResourceRecordSetsRequest{Changes: []r53.Change{r53.Change{Action: "UPSERT", Record: r53.ResourceRecordSet{Name: record, Type: "A", TTL: 300, Records: []string{publicIp}}}}}
-	_, err = r53c.ChangeResourceRecordSets(zoneId, req)
-	if err != nil {
-		log.Fatal(err)
+	return records, nil
+}
+
+// Quoted TXT character strings, longer than 255 characters are split
+func txtValue(pairs ...string) string {
+	var quoted []string
+	for _, pair := range pairs {
+		for len(pair) > 255 {
+			quoted = append(quoted, strconv.Quote(pair[:255]))
+			pair = pair[255:]
+		}
+		quoted = append(quoted, strconv.Quote(pair))
 	}
+	return strings.Join(quoted, " ")
 }
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	r53 "github.com/mitchellh/goamz/route53"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory ETCD v2 keys API, enough for the index allocation
+type fakeEtcd struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+	keys map[string]string
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{dirs: make(map[string]bool), keys: make(map[string]string)}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	query := r.URL.Query()
+	reply := func(status int, node EtcdNode) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(&EtcdOp{Action: strings.ToLower(r.Method), Node: node})
+	}
+	switch r.Method {
+	case "GET":
+		if query.Get("recursive") == "true" {
+			dir := EtcdNode{Key: key, Dir: true}
+			for k, v := range f.keys {
+				if strings.HasPrefix(k, key+"/") {
+					dir.Nodes = append(dir.Nodes, EtcdNode{Key: k, Value: v})
+				}
+			}
+			if !f.dirs[key] && len(dir.Nodes) == 0 {
+				reply(http.StatusNotFound, EtcdNode{})
+				return
+			}
+			reply(http.StatusOK, dir)
+			return
+		}
+		value, ok := f.keys[key]
+		if !ok {
+			reply(http.StatusNotFound, EtcdNode{})
+			return
+		}
+		reply(http.StatusOK, EtcdNode{Key: key, Value: value})
+	case "PUT":
+		if query.Get("dir") == "true" {
+			if f.dirs[key] {
+				reply(http.StatusPreconditionFailed, EtcdNode{})
+				return
+			}
+			f.dirs[key] = true
+			reply(http.StatusCreated, EtcdNode{Key: key, Dir: true})
+			return
+		}
+		r.ParseForm()
+		value := r.PostForm.Get("value")
+		current, exists := f.keys[key]
+		if query.Get("prevExist") == "false" && exists ||
+			query.Get("prevExist") == "true" && !exists ||
+			query.Has("prevValue") && current != query.Get("prevValue") {
+			reply(http.StatusPreconditionFailed, EtcdNode{})
+			return
+		}
+		if query.Get("refresh") == "true" {
+			reply(http.StatusOK, EtcdNode{Key: key, Value: current})
+			return
+		}
+		f.keys[key] = value
+		reply(http.StatusCreated, EtcdNode{Key: key, Value: value})
+	case "DELETE":
+		current, exists := f.keys[key]
+		if !exists {
+			reply(http.StatusNotFound, EtcdNode{})
+			return
+		}
+		if query.Has("prevValue") && current != query.Get("prevValue") {
+			reply(http.StatusPreconditionFailed, EtcdNode{})
+			return
+		}
+		delete(f.keys, key)
+		reply(http.StatusOK, EtcdNode{Key: key})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Points the etcd2Store at the endpoints with the flag defaults that matter
+func useEtcd(endpoints ...string) {
+	ctx = context.Background()
+	httpClient = &http.Client{Timeout: time.Second}
+	etcdEndpoints = endpoints
+	etcdClient, _ = newEtcdClient()
+	etcdCurrent = 0
+	etcdRetryDelay = 10 * time.Millisecond
+	etcdRetryTimeout = 100 * time.Millisecond
+	maxEtcdRedirects = 10
+	etcdPrefix, tagPrefix, tagName = "/cloudtag", "machine-", "Name"
+	indexStart, maxIndex, indexTtl, indexWait = 1, 100, 0, 0
+	dryRun = false
+	store = &etcd2Store{}
+}
+
+// Run by TestConcurrentAllocation as a separate process, one per machine
+func TestAllocationProcess(t *testing.T) {
+	endpoint := os.Getenv("CLOUDTAG_TEST_ETCD")
+	if endpoint == "" {
+		t.Skip("only run by TestConcurrentAllocation")
+	}
+	useEtcd(endpoint)
+	index, err := waitIndex(os.Getenv("CLOUDTAG_TEST_MID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("index=%d\n", index)
+}
+
+func TestConcurrentAllocation(t *testing.T) {
+	etcd := newFakeEtcd()
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	// every machine boots twice at once, e.g. a unit restarted while the first run still hangs on ETCD
+	const machines = 10
+	type run struct {
+		mid string
+		out []byte
+		err error
+	}
+	runs := make([]run, 2*machines)
+	var wg sync.WaitGroup
+	for i := range runs {
+		runs[i].mid = fmt.Sprintf("machine-id-%d", i%machines)
+		wg.Add(1)
+		go func(r *run) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestAllocationProcess$")
+			cmd.Env = append(os.Environ(), "CLOUDTAG_TEST_ETCD="+server.URL, "CLOUDTAG_TEST_MID="+r.mid)
+			r.out, r.err = cmd.Output()
+		}(&runs[i])
+	}
+	wg.Wait()
+
+	indexPattern := regexp.MustCompile(`(?m)^index=([0-9]+)$`)
+	indexOf := make(map[string]int)
+	for _, r := range runs {
+		if r.err != nil {
+			t.Fatalf("%s: %v\n%s", r.mid, r.err, r.out)
+		}
+		match := indexPattern.FindSubmatch(r.out)
+		if match == nil {
+			t.Fatalf("%s: no index in output\n%s", r.mid, r.out)
+		}
+		index, _ := strconv.Atoi(string(match[1]))
+		if got, seen := indexOf[r.mid]; seen && got != index {
+			t.Errorf("%s got index %d and %d", r.mid, got, index)
+		}
+		indexOf[r.mid] = index
+	}
+	midOf := make(map[int]string)
+	for mid, index := range indexOf {
+		if other, taken := midOf[index]; taken {
+			t.Errorf("index %d is given to both %s and %s", index, other, mid)
+		}
+		midOf[index] = mid
+	}
+	if len(etcd.keys) != machines {
+		t.Errorf("expected %d index keys, got %d: %v", machines, len(etcd.keys), etcd.keys)
+	}
+	for key, value := range etcd.keys {
+		index := etcdKeyIndex(key)
+		if mid := etcdOwner(value); indexOf[mid] != index {
+			t.Errorf("key %s holds %s, which was given index %d", key, mid, indexOf[mid])
+		}
+	}
+}
+
+func TestFindIndexReusesOwnSlot(t *testing.T) {
+	server := httptest.NewServer(newFakeEtcd())
+	defer server.Close()
+	useEtcd(server.URL)
+
+	first, err := waitIndex("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := waitIndex("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := waitIndex("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || second != 2 || again != first {
+		t.Errorf("expected indexes 1, 2, 1, got %d, %d, %d", first, second, again)
+	}
+}
+
+// Instance metadata service with the IMDSv2 token API
+func newFakeImds(values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "token")
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		value, ok := values[strings.TrimPrefix(r.URL.Path, "/latest/meta-data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, value)
+	}))
+}
+
+// Forgets the token and cached values of the previous test
+func useMetadata(url string) {
+	ctx = context.Background()
+	metadataUrl = url + "/latest/meta-data/"
+	metadataClient = &http.Client{Timeout: time.Second}
+	imdsVersion = "auto"
+	metadataToken, metadataTokenFetched = "", false
+	metadataCache = make(map[string]cachedMetadata)
+	metadataRetries, metadataRetryDelay, metadataCacheTtl = 0, 10*time.Millisecond, 0
+	identityDoc, regionOverride, instanceIdOverride = false, "", ""
+}
+
+func TestMetadataUrl(t *testing.T) {
+	server := newFakeImds(map[string]string{
+		"instance-id":                 "i-0123456789abcdef0",
+		"placement/availability-zone": "eu-west-1b",
+		"public-ipv4":                 "203.0.113.7",
+	})
+	defer server.Close()
+	useMetadata(server.URL)
+
+	instance, zone, region, err := (&awsCloud{}).Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance != "i-0123456789abcdef0" || zone != "eu-west-1b" || region != "eu-west-1" {
+		t.Errorf("expected i-0123456789abcdef0 in eu-west-1b of eu-west-1, got %s in %s of %s", instance, zone, region)
+	}
+	ip, err := metadata("public-ipv4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "203.0.113.7" {
+		t.Errorf("expected public IP 203.0.113.7, got %s", ip)
+	}
+	_, found, err := metadataOptional("ipv6")
+	if err != nil || found {
+		t.Errorf("expected missing ipv6 to be not found, got found=%v, error %v", found, err)
+	}
+}
+
+// Replies after the delay, stalling either before the headers or in the middle of the body
+func newSlowServer(delay time.Duration, headersFirst bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if headersFirst {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "partial")
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, "late")
+	}))
+}
+
+func TestHttpTimeout(t *testing.T) {
+	for _, headersFirst := range []bool{false, true} {
+		server := newSlowServer(5*time.Second, headersFirst)
+
+		useMetadata(server.URL)
+		imdsVersion = "v1"
+		metadataClient.Timeout = 50 * time.Millisecond
+		start := time.Now()
+		if _, err := metadata("instance-id"); err == nil {
+			t.Errorf("metadata: expected timeout error, headers first %v", headersFirst)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("metadata: timeout took %v, headers first %v", elapsed, headersFirst)
+		}
+
+		useEtcd(server.URL)
+		etcdClient.Timeout = 50 * time.Millisecond
+		start = time.Now()
+		if _, err := get(1); err == nil {
+			t.Errorf("etcd: expected timeout error, headers first %v", headersFirst)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("etcd: timeout took %v, headers first %v", elapsed, headersFirst)
+		}
+		server.Close()
+	}
+}
+
+func TestEtcdEndpoint(t *testing.T) {
+	defer func(scheme string) { etcdScheme = scheme }(etcdScheme)
+	for _, c := range []struct{ scheme, address, endpoint string }{
+		{"http", "127.0.0.1:2379", "http://127.0.0.1:2379"},
+		{"https", "etcd.internal:2379", "https://etcd.internal:2379"},
+		{"http", "https://etcd.internal:2379", "https://etcd.internal:2379"},
+		{"https", "http://127.0.0.1:4001", "http://127.0.0.1:4001"},
+	} {
+		etcdScheme = c.scheme
+		if endpoint := etcdEndpoint(c.address); endpoint != c.endpoint {
+			t.Errorf("-etcd-scheme=%s -etcd=%s: expected %s, got %s", c.scheme, c.address, c.endpoint, endpoint)
+		}
+	}
+	if path := etcdPath("/cloudtag", "machine-", "Name", 7); path != "/v2/keys/cloudtag/machine-Name/7" {
+		t.Errorf("unexpected key path %s", path)
+	}
+}
+
+// A follower that advertises the leader with http:// must not downgrade a TLS connection
+func TestEtcdRedirectKeepsScheme(t *testing.T) {
+	etcd := newFakeEtcd()
+	etcd.keys["/cloudtag/machine-Name/1"] = "a"
+	var schemes []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schemes = append(schemes, r.URL.Query().Get("leader"))
+		if r.URL.Query().Get("leader") == "" {
+			http.Redirect(w, r, "http://"+r.Host+r.URL.Path+"?leader=yes", http.StatusTemporaryRedirect)
+			return
+		}
+		etcd.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	useEtcd(server.URL)
+	etcdClient = manualRedirects(server.Client())
+
+	value, err := get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "a" {
+		t.Errorf("expected a, got %s", value)
+	}
+	if len(schemes) != 2 {
+		t.Errorf("expected the request to reach the leader over TLS after one redirect, got %v", schemes)
+	}
+}
+
+// Counts the requests that reach the handler
+func counting(count *int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*count++
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestEtcdFailover(t *testing.T) {
+	var failed, good int
+	broken := httptest.NewServer(counting(&failed, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})))
+	defer broken.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	etcd := newFakeEtcd()
+	etcd.keys["/cloudtag/machine-Name/1"] = "a"
+	server := httptest.NewServer(counting(&good, etcd))
+	defer server.Close()
+
+	for _, first := range []string{broken.URL, down.URL} {
+		useEtcd(first, server.URL)
+		failed, good = 0, 0
+		value, err := get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "a" || etcdCurrent != 1 {
+			t.Errorf("%s: expected a from the second endpoint, got %s from endpoint %d", first, value, etcdCurrent)
+		}
+		// the endpoint that worked is tried first next time
+		if _, err = get(2); err != nil {
+			t.Fatal(err)
+		}
+		if first == broken.URL && failed != 1 || good != 2 {
+			t.Errorf("%s: expected 1 request to the failing endpoint and 2 to the good one, got %d and %d", first, failed, good)
+		}
+	}
+}
+
+// 412 is an answer, not a failure, the slot is taken whatever the other members say
+func TestEtcdPreconditionFailedIsAuthoritative(t *testing.T) {
+	var first, second int
+	taken := newFakeEtcd()
+	taken.dirs["/cloudtag/machine-Name"] = true
+	taken.keys["/cloudtag/machine-Name/1"] = "a"
+	one := httptest.NewServer(counting(&first, taken))
+	defer one.Close()
+	two := httptest.NewServer(counting(&second, newFakeEtcd()))
+	defer two.Close()
+	useEtcd(one.URL, two.URL)
+
+	ok, err := store.CreateIfAbsent(1, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected taken slot to stay taken")
+	}
+	if first == 0 || second != 0 {
+		t.Errorf("expected only the first endpoint to be asked, got %d and %d requests", first, second)
+	}
+}
+
+func TestZonesNamedPaginates(t *testing.T) {
+	pages := map[string]*r53.ListHostedZonesResponse{
+		"": {HostedZones: []r53.HostedZone{{ID: "/hostedzone/Z1", Name: "example.com."}, {ID: "/hostedzone/Z2", Name: "example.net."}},
+			IsTruncated: true, NextMarker: "Z3"},
+		"Z3": {HostedZones: []r53.HostedZone{{ID: "/hostedzone/Z3", Name: "internal.example.org."}, {ID: "/hostedzone/Z4", Name: "example.org."}}},
+	}
+	var markers []string
+	list := func(marker string) (*r53.ListHostedZonesResponse, error) {
+		markers = append(markers, marker)
+		return pages[marker], nil
+	}
+	matching, err := zonesNamed("example.org.", list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matching) != 1 || matching[0].ID != "/hostedzone/Z4" {
+		t.Errorf("expected the zone from the second page, got %+v", matching)
+	}
+	if strings.Join(markers, ",") != ",Z3" {
+		t.Errorf("expected pages at markers \"\" and Z3, got %q", markers)
+	}
+
+	throttled := errors.New("throttled")
+	_, err = zonesNamed("example.org.", func(marker string) (*r53.ListHostedZonesResponse, error) {
+		if marker != "" {
+			return nil, throttled
+		}
+		return pages[marker], nil
+	})
+	if err != throttled {
+		t.Errorf("expected the second page error, got %v", err)
+	}
+}
+
+func TestMachineIdFile(t *testing.T) {
+	defer func(path string) { machineIdPath = path }(machineIdPath)
+	dir := t.TempDir()
+	machineIdPath = filepath.Join(dir, "machine-id")
+
+	if err := os.WriteFile(machineIdPath, []byte("0123456789abcdef0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mid, err := machineId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mid != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("expected the id without newline, got %q", mid)
+	}
+
+	if err := os.WriteFile(machineIdPath, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if mid, err = machineId(); err == nil {
+		t.Errorf("expected error on empty machine id file, got %q", mid)
+	}
+
+	machineIdPath = filepath.Join(dir, "missing")
+	if mid, err = machineId(); err == nil {
+		t.Errorf("expected error on missing machine id file, got %q", mid)
+	}
+}
+
+func openFds(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open files:", err)
+	}
+	return len(fds)
+}
+
+// Every reply, failed or not, must give the connection back, or retries pile up open sockets
+func TestMetadataClosesBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/latest/meta-data/") {
+		case "public-ipv4":
+			fmt.Fprint(w, "203.0.113.7")
+		case "local-ipv4":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "try again")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	useMetadata(server.URL)
+	imdsVersion = "v1"
+	metadataRetries, metadataRetryDelay = 2, time.Millisecond
+
+	metadata("public-ipv4")
+	before := openFds(t)
+	for i := 0; i < 100; i++ {
+		if _, err := metadata("public-ipv4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := metadata("local-ipv4"); err == nil {
+			t.Fatal("expected error on 500")
+		}
+		if _, found, err := metadataOptional("ipv6"); found || err != nil {
+			t.Fatalf("expected not found, got found=%v, error %v", found, err)
+		}
+	}
+	if after := openFds(t); after > before+10 {
+		t.Errorf("open files grew from %d to %d", before, after)
+	}
+}
+
+func TestEtcdValueEncoding(t *testing.T) {
+	etcd := newFakeEtcd()
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+	useEtcd(server.URL)
+
+	value := `{"machine_id":"a&b=c+d %20e","hostname":"x?y#z","note":"{}"}`
+	ok, err := store.CreateIfAbsent(1, value)
+	if err != nil || !ok {
+		t.Fatalf("expected the slot to be created, got ok=%v, error %v", ok, err)
+	}
+	if stored := etcd.keys["/cloudtag/machine-Name/1"]; stored != value {
+		t.Errorf("expected ETCD to store %s, got %s", value, stored)
+	}
+	got, err := store.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != value {
+		t.Errorf("expected %s back, got %s", value, got)
+	}
+	if owner, _ := get(1); owner != "a&b=c+d %20e" {
+		t.Errorf("unexpected owner %q", owner)
+	}
+	// prevValue travels in the query string
+	if ok, err = remove("a&b=c+d %20e", 1); err != nil || !ok {
+		t.Errorf("expected the slot to be removed, got ok=%v, error %v", ok, err)
+	}
+}
+
+// User-data is read first at boot, while the metadata service may still be coming up
+func TestUserDataRetried(t *testing.T) {
+	failures := 2
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/latest/user-data" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "cloudtag:\n  tag-name: Role\n")
+	}))
+	defer server.Close()
+	useMetadata(server.URL)
+	imdsVersion = "v1"
+	metadataRetries, metadataRetryDelay = 3, time.Millisecond
+
+	data, err := userData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(data, "tag-name: Role") {
+		t.Errorf("unexpected user-data %q", data)
+	}
+
+	metadataUrl = server.URL + "/nothing/meta-data/"
+	if data, err = userData(); err != nil || data != "" {
+		t.Errorf("expected no user-data and no error on 404, got %q, error %v", data, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/ec2"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// preflight command, read-only checks of what a run needs, to catch misconfiguration before the host is enrolled
+func preflight(cloud Cloud) error {
+	failed := 0
+	check := func(what string, detail string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", what, err)
+		} else {
+			fmt.Printf("PASS  %s: %s\n", what, detail)
+		}
+	}
+
+	instance, zone, region, identityErr := cloud.Identity()
+	if regionOverride != "" {
+		region = regionOverride
+	}
+	check("instance metadata", fmt.Sprintf("instance %s in %s", instance, region), identityErr)
+	etcdRegion = region
+	held, err := list()
+	check("index store", fmt.Sprintf("%s backend, %d of %d slots held", backend, len(held), maxIndex-indexStart), err)
+
+	if cloudName == "aws" && identityErr != nil {
+		fmt.Println("SKIP  AWS checks: instance identity is unknown")
+	} else if cloudName == "aws" {
+		r53c, ec2c, _, err := awsClients(region)
+		check("AWS credentials", "found", err)
+		if err == nil {
+			if tagging() {
+				m := &Machine{Id: instance, Index: indexStart, Instance: instance, Region: region, Zone: zone}
+				check("ec2:CreateTags", "allowed on "+strings.Join(taggedResources(m), ", "), dryRunTags(ec2c, m))
+			}
+			var vpcId string
+			if dnsPrivate && len(dnsZones) > 0 {
+				vpcId, err = vpc()
+				check("instance VPC", vpcId, err)
+			}
+			for _, zone := range dnsZones {
+				zoneId, err := findZoneId(r53c, zone, vpcId)
+				if err == nil && zoneId == "" {
+					err = errors.New(fmt.Sprintf("No hosted zone %s is visible", zone))
+				}
+				check("Route53 zone "+zone, zoneId, err)
+			}
+		}
+	}
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("%d preflight checks failed", failed))
+	}
+	return nil
+}
+
+// CreateTags with DryRun=true, EC2 replies DryRunOperation if the call would have succeeded and UnauthorizedOperation if not
+func dryRunTags(ec2c *ec2.EC2, m *Machine) error {
+	params := url.Values{}
+	params.Set("Action", "CreateTags")
+	params.Set("Version", "2016-11-15")
+	params.Set("DryRun", "true")
+	for i, id := range taggedResources(m) {
+		params.Set("ResourceId."+strconv.Itoa(i+1), id)
+	}
+	tags, err := instanceTags(m)
+	if err != nil {
+		return err
+	}
+	for i, tag := range tags {
+		member := "Tag." + strconv.Itoa(i+1) + "."
+		params.Set(member+"Key", tag.Key)
+		params.Set(member+"Value", tag.Value)
+	}
+	_, err = awsCall(ec2c.Auth, ec2c.Region, "ec2", "POST", ec2c.Region.EC2Endpoint+"/", "application/x-www-form-urlencoded", params.Encode())
+	if err != nil && strings.Contains(err.Error(), "DryRunOperation") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Instance metadata endpoints of all clouds, link-local or resolvable only inside the cloud
+var metadataHosts = []string{"169.254.169.254", "metadata.google.internal"}
+
+// -proxy overrides HTTP_PROXY and HTTPS_PROXY; metadata hosts are added to NO_PROXY as goamz reads
+// instance role credentials with its own client, that only consults the environment
+func setupProxy() error {
+	if proxyUrl != "" {
+		u, err := url.Parse(proxyUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New(fmt.Sprintf("proxy must be http:// or https:// URL, got `%s`", proxyUrl))
+		}
+		os.Setenv("HTTP_PROXY", proxyUrl)
+		os.Setenv("HTTPS_PROXY", proxyUrl)
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	bypass := append(strings.FieldsFunc(noProxy, func(r rune) bool { return r == ',' }), metadataHosts...)
+	os.Setenv("NO_PROXY", strings.Join(bypass, ","))
+	metadataClient = newMetadataClient()
+	return nil
+}
+
+// Instance metadata is never reached through a proxy
+func newMetadataClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	return &http.Client{Timeout: httpTimeout, Transport: transport}
+}
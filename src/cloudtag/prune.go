@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/mitchellh/goamz/ec2"
+	r53 "github.com/mitchellh/goamz/route53"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Deletes A records in our -dns-name-template namespace that point to IPs of no running instance
+func pruneDns(r53c *r53.Route53, ec2c *ec2.EC2, m *Machine) error {
+	for _, zone := range dnsZones {
+		err := pruneZone(r53c, ec2c, zone, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneZone(r53c *r53.Route53, ec2c *ec2.EC2, zone string, m *Machine) error {
+	zoneId, err := dnsZoneId(r53c, zone, m.Vpc)
+	if err != nil {
+		return err
+	}
+	records, err := zoneRecords(r53c, zoneId)
+	if err != nil {
+		return err
+	}
+	namespace, err := dnsNamePattern(m, zone)
+	if err != nil {
+		return err
+	}
+	var candidates []r53.ResourceRecordSet
+	var ips []string
+	for _, record := range records {
+		if record.Type == "A" && record.AliasTarget == nil && namespace.MatchString(record.Name) {
+			candidates = append(candidates, record)
+			ips = append(ips, record.Records...)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	running, err := runningIps(ec2c, ips)
+	if err != nil {
+		return err
+	}
+	var changes []r53.Change
+	for _, record := range candidates {
+		alive := false
+		for _, ip := range record.Records {
+			alive = alive || running[ip]
+		}
+		if !alive {
+			slog.Info("pruning stale DNS record", "name", record.Name, "values", record.Records)
+			changes = append(changes, r53.Change{Action: "DELETE", Record: record})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return awsRetry(func() error {
+		_, err := r53c.ChangeResourceRecordSets(zoneId, &r53.ChangeResourceRecordSetsRequest{Changes: changes})
+		return err
+	})
+}
+
+// Machine record names of any index, the index placeholder matches digits
+func dnsNamePattern(m *Machine, zone string) (*regexp.Regexp, error) {
+	values := templateValues(m)
+	values["zone"] = zone
+	values["index"] = "\x00"
+	name, err := render(dnsNameTmpl, values)
+	if err != nil {
+		return nil, err
+	}
+	name = regexp.QuoteMeta(name)
+	return regexp.MustCompile("^" + strings.Replace(name, "\x00", "[0-9]+", -1) + "$"), nil
+}
+
+// All record sets of the zone, following the pagination
+func zoneRecords(r53c *r53.Route53, zoneId string) (records []r53.ResourceRecordSet, err error) {
+	return allRecords(func(opts *r53.ListOpts) (res *r53.ListResourceRecordSetsResponse, err error) {
+		err = awsRetry(func() (err error) {
+			res, err = r53c.ListResourceRecordSets(zoneId, opts)
+			return
+		})
+		return
+	})
+}
+
+// Records from all pages of the listing, each page starting where the previous one said
+func allRecords(list func(opts *r53.ListOpts) (*r53.ListResourceRecordSetsResponse, error)) (records []r53.ResourceRecordSet, err error) {
+	opts := &r53.ListOpts{}
+	for {
+		res, err := list(opts)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, res.Records...)
+		if !res.IsTruncated {
+			return records, nil
+		}
+		opts = &r53.ListOpts{Name: res.NextRecordName, Type: res.NextRecordType, Identifier: res.NextRecordIdentifier}
+	}
+}
+
+// At most this many values in one EC2 filter
+const filterValuesMax = 200
+
+// IPs of pending and running instances among ips, public or private; the records may carry private
+// IPs even with public -dns-ip-source, as instances without public IP publish local-ipv4 instead
+func runningIps(ec2c *ec2.EC2, ips []string) (map[string]bool, error) {
+	running := make(map[string]bool)
+	for start := 0; start < len(ips); start += filterValuesMax {
+		chunk := ips[start:min(start+filterValuesMax, len(ips))]
+		for _, name := range []string{"ip-address", "private-ip-address"} {
+			filter := ec2.NewFilter()
+			filter.Add("instance-state-name", "pending", "running")
+			filter.Add(name, chunk...)
+			var res *ec2.InstancesResp
+			err := awsRetry(func() (err error) {
+				res, err = ec2c.Instances(nil, filter)
+				return
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, reservation := range res.Reservations {
+				for _, instance := range reservation.Instances {
+					if instance.IPAddress != "" {
+						running[instance.IPAddress] = true
+					}
+					running[instance.PrivateIPAddress] = true
+				}
+			}
+		}
+	}
+	return running, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	r53 "github.com/mitchellh/goamz/route53"
+	"testing"
+)
+
+func TestAllRecordsPaginates(t *testing.T) {
+	pages := []*r53.ListResourceRecordSetsResponse{
+		{Records: []r53.ResourceRecordSet{{Name: "example.com.", Type: "NS"}, {Name: "web-1.example.com.", Type: "A", SetIdentifier: "a"}},
+			IsTruncated: true, NextRecordName: "web-1.example.com.", NextRecordType: "A", NextRecordIdentifier: "b"},
+		{Records: []r53.ResourceRecordSet{{Name: "web-1.example.com.", Type: "A", SetIdentifier: "b"}, {Name: "web-2.example.com.", Type: "A"}}},
+	}
+	var calls []r53.ListOpts
+	records, err := allRecords(func(opts *r53.ListOpts) (*r53.ListResourceRecordSetsResponse, error) {
+		calls = append(calls, *opts)
+		return pages[len(calls)-1], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[3].Name != "web-2.example.com." {
+		t.Errorf("expected the records of both pages, got %+v", records)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 pages, got %d", len(calls))
+	}
+	if calls[0] != (r53.ListOpts{}) {
+		t.Errorf("expected the first page from the start, got %+v", calls[0])
+	}
+	if next := (r53.ListOpts{Name: "web-1.example.com.", Type: "A", Identifier: "b"}); calls[1] != next {
+		t.Errorf("expected the second page at %+v, got %+v", next, calls[1])
+	}
+}
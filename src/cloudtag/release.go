@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// release command, frees the slot of a machine replaced out-of-band
+func release() error {
+	index, mid := releaseIndex, releaseMachineId
+	if index < 0 && mid == "" {
+		return errors.New("release needs -index or -machine-id")
+	}
+	if index >= 0 {
+		owner, err := get(index)
+		if err != nil {
+			return err
+		}
+		if owner == "" {
+			return errors.New(fmt.Sprintf("Index %d is free already", index))
+		}
+		if mid != "" && owner != mid {
+			return errors.New(fmt.Sprintf("Index %d is held by machine id %s, not %s", index, owner, mid))
+		}
+		mid = owner
+	} else {
+		held, err := list()
+		if err != nil {
+			return err
+		}
+		for i, owner := range held {
+			if owner == mid {
+				index = i
+			}
+		}
+		if index < 0 {
+			return errors.New(fmt.Sprintf("No index is held by machine id %s", mid))
+		}
+	}
+	ok, err := remove(mid, index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("Index %d changed hands meanwhile, not releasing", index))
+	}
+	slog.Info("released index", "index", index, "machine_id", mid)
+	return nil
+}
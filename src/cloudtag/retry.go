@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/mitchellh/goamz/ec2"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Calls AWS up to -aws-retries more times on throttling and server errors, with exponential backoff and jitter
+func awsRetry(call func() error) error {
+	wait := awsRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := withContext(call)
+		if err == nil || attempt > awsRetries || !awsRetryable(err) {
+			return err
+		}
+		delay := jitter(wait)
+		slog.Warn("AWS call failed, retrying", "error", err, "attempt", attempt, "delay", delay)
+		err = sleep(delay)
+		if err != nil {
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// goamz calls take no context, so the call is left behind when -timeout cancels ctx
+func withContext(call func() error) error {
+	if ctx.Done() == nil {
+		return call()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sleeps unless ctx is cancelled by -timeout meanwhile
+func sleep(wait time.Duration) error {
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Random delay between half and one and half of wait, so that machines booted together do not retry in lockstep
+func jitter(wait time.Duration) time.Duration {
+	if wait <= 0 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait)))
+}
+
+var awsRetryableCodes = []string{"RequestLimitExceeded", "Throttling", "PriorRequestNotComplete", "ServiceUnavailable", "InternalError", "Unavailable", "ProvisionedThroughputExceeded"}
+
+func awsRetryable(err error) bool {
+	if e, ok := err.(*ec2.Error); ok {
+		if e.StatusCode >= 500 {
+			return true
+		}
+		for _, code := range awsRetryableCodes {
+			if e.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	// route53 and awsCall errors carry the code in the message only
+	msg := err.Error()
+	for _, code := range awsRetryableCodes {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	return strings.Contains(msg, "failed with 5")
+}
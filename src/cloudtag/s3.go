@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// S3 objects at <s3-prefix>/<tag-prefix><tag-name>/<index>, created with If-None-Match: *
+// and deleted with If-Match: <etag>; there is no TTL
+type s3Store struct {
+	bucket string
+	region string // resolved on first call, -region or instance metadata
+}
+
+type S3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func newS3Store(bucket string) *s3Store {
+	return &s3Store{bucket: bucket}
+}
+
+func s3Dir() string {
+	return strings.TrimPrefix(etcdDir(strings.TrimSuffix(s3Prefix, "/"), tagPrefix, tagName), "/")
+}
+
+func s3Key(index int) string {
+	return s3Dir() + "/" + strconv.Itoa(index)
+}
+
+// Sends the signed request, the reply is returned whatever the status
+func (s *s3Store) do(method string, key string, query url.Values, header http.Header, body string) (res *http.Response, reply []byte, err error) {
+	if s.region == "" {
+		s.region, err = storeRegion()
+		if err != nil {
+			return
+		}
+	}
+	auth, err := awsAuth()
+	if err != nil {
+		return
+	}
+	location := "https://" + s.bucket + ".s3." + s.region + ".amazonaws.com/" + key
+	if awsEndpoint != "" {
+		// path style for LocalStack and the like
+		location = awsEndpoint + "/" + s.bucket + "/" + key
+	}
+	if len(query) > 0 {
+		location += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, location, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sum := sha256.Sum256([]byte(body))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	aws.NewV4Signer(auth, "s3", aws.Region{Name: s.region}).Sign(req)
+	slog.Debug("sending", "method", req.Method, "url", req.URL.Redacted())
+	res, err = httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	reply, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	slog.Debug("got", "status", res.Status, "body", string(reply))
+	return
+}
+
+func s3Error(method string, key string, res *http.Response, reply []byte) error {
+	return errors.New(fmt.Sprintf("S3 %s %s failed with %v: %s", method, key, res.Status, reply))
+}
+
+// Object body and ETag, empty if there is no object
+func (s *s3Store) get(key string) (value string, etag string, err error) {
+	res, reply, err := s.do("GET", key, nil, nil, "")
+	if err != nil {
+		return
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return "", "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", "", s3Error("GET", key, res, reply)
+	}
+	return string(reply), res.Header.Get("ETag"), nil
+}
+
+func (s *s3Store) List() (values map[int]string, err error) {
+	values = make(map[int]string)
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s3Dir()+"/")
+	for {
+		res, reply, err := s.do("GET", "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, s3Error("GET", "?"+query.Encode(), res, reply)
+		}
+		var list S3ListResult
+		err = xml.Unmarshal(reply, &list)
+		if err != nil {
+			return nil, err
+		}
+		// listing has keys only, the holders are read one by one
+		for _, object := range list.Contents {
+			index := etcdKeyIndex(object.Key)
+			if index < 0 {
+				continue
+			}
+			value, _, err := s.get(object.Key)
+			if err != nil {
+				return nil, err
+			}
+			if value != "" {
+				values[index] = value
+			}
+		}
+		if !list.IsTruncated {
+			return values, nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+func (s *s3Store) Get(index int) (value string, err error) {
+	value, _, err = s.get(s3Key(index))
+	return
+}
+
+// 412 means the object exists, 409 that a concurrent conditional write won
+func (s *s3Store) CreateIfAbsent(index int, value string) (ok bool, err error) {
+	key := s3Key(index)
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+	header.Set("Content-Type", "application/json")
+	res, reply, err := s.do("PUT", key, nil, header, value)
+	if err != nil {
+		return
+	}
+	if res.StatusCode == http.StatusPreconditionFailed || res.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, s3Error("PUT", key, res, reply)
+	}
+	return true, nil
+}
+
+// -index-ttl is not supported, run() refuses the combination
+func (s *s3Store) Refresh(index int, value string) error {
+	return errors.New("S3 index TTL is not supported")
+}
+
+// Compares the body, then deletes only if the object was not rewritten meanwhile
+func (s *s3Store) Delete(index int, prevValue string) (ok bool, err error) {
+	key := s3Key(index)
+	value, etag, err := s.get(key)
+	if err != nil || value != prevValue {
+		return
+	}
+	header := http.Header{}
+	header.Set("If-Match", etag)
+	res, reply, err := s.do("DELETE", key, nil, header, "")
+	if err != nil {
+		return
+	}
+	if res.StatusCode == http.StatusPreconditionFailed || res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return false, s3Error("DELETE", key, res, reply)
+	}
+	return true, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"net/url"
+	"strings"
+)
+
+type AllocationMessage struct {
+	Index      int    `json:"index"`
+	InstanceId string `json:"instance_id"`
+	Region     string `json:"region"`
+	Fqdn       string `json:"fqdn,omitempty"`
+}
+
+// Publishes the allocation to -sns-topic-arn, the topic region is taken from the ARN
+func publishAllocation(m *Machine) error {
+	arn := strings.Split(snsTopicArn, ":")
+	if len(arn) != 6 || arn[2] != "sns" {
+		return errors.New(fmt.Sprintf("Not an SNS topic ARN `%s`", snsTopicArn))
+	}
+	region := arn[3]
+	message := AllocationMessage{Index: m.Index, InstanceId: m.Instance, Region: m.Region}
+	if len(dnsZones) > 0 {
+		fqdn, err := dnsName(m, dnsZones[0])
+		if err != nil {
+			return err
+		}
+		message.Fqdn = strings.TrimSuffix(fqdn, ".")
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	auth, err := awsAuth()
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("Action", "Publish")
+	params.Set("Version", "2010-03-31")
+	params.Set("TopicArn", snsTopicArn)
+	params.Set("Subject", "cloudtag index allocated")
+	params.Set("Message", string(body))
+	endpoint := "https://sns." + region + ".amazonaws.com/"
+	if awsEndpoint != "" {
+		endpoint = awsEndpoint + "/"
+	}
+	return awsRetry(func() error {
+		_, err := awsCall(auth, aws.Region{Name: region}, "sns", "POST", endpoint, "application/x-www-form-urlencoded", params.Encode())
+		return err
+	})
+}
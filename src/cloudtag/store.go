@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Where the index slots are kept, selected with -backend; findIndex() and friends only use this
+type IndexStore interface {
+	// all taken slots by index, nil if the slots were never written to
+	List() (values map[int]string, err error)
+	// slot value, empty if the slot is free
+	Get(index int) (value string, err error)
+	// atomic create, ok is false if the slot is taken
+	CreateIfAbsent(index int, value string) (ok bool, err error)
+	// extends -index-ttl of the slot while it still holds the value
+	Refresh(index int, value string) error
+	// deletes the slot only if it still holds the value, ok is false otherwise
+	Delete(index int, prevValue string) (ok bool, err error)
+}
+
+var store IndexStore
+
+// Returns the machine id holding the index, empty if the index is free
+func get(index int) (id string, err error) {
+	value, err := store.Get(index)
+	if err != nil {
+		return
+	}
+	return etcdOwner(value), nil
+}
+
+// Returns machine ids holding the slots by index, nil if the slots were never written to
+func list() (held map[int]string, err error) {
+	values, err := store.List()
+	if err != nil || values == nil {
+		return
+	}
+	held = make(map[int]string)
+	for index, value := range values {
+		held[index] = etcdOwner(value)
+	}
+	return held, nil
+}
+
+func put(mid string, index int) (ok bool, err error) {
+	return store.CreateIfAbsent(index, etcdValue(mid))
+}
+
+// Extends the index key TTL, only while the key still holds our machine id
+func refresh(mid string, index int) error {
+	value, err := store.Get(index)
+	if err != nil {
+		return err
+	}
+	if etcdOwner(value) != mid {
+		return errors.New(fmt.Sprintf("Cannot refresh TTL of machine index %d, it is not held by machine id %s anymore", index, mid))
+	}
+	return store.Refresh(index, value)
+}
+
+// Deletes the index key only if it still holds our machine id, ok is false otherwise
+func remove(mid string, index int) (ok bool, err error) {
+	value, err := store.Get(index)
+	if err != nil {
+		return
+	}
+	if etcdOwner(value) != mid {
+		return false, nil
+	}
+	return store.Delete(index, value)
+}
+
+// Frees the slots, other than index, that hold our instance id or hostname under another machine id,
+// left behind when the host was re-imaged and came back with a new machine id
+func reclaim(mid string, index int) error {
+	values, err := store.List()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	for i, value := range values {
+		v := parseEtcdValue(value)
+		if i == index || v.MachineId == mid {
+			continue
+		}
+		// default hostnames like ip-10-0-1-5 repeat across VPCs and regions, so the hostname
+		// is only trusted when the slot does not record an instance id
+		var stale bool
+		if v.InstanceId != "" && instanceId != "" {
+			stale = v.InstanceId == instanceId
+		} else {
+			stale = v.InstanceId == "" && hostname != "" && hostname != "localhost" && v.Hostname == hostname
+		}
+		if !stale {
+			continue
+		}
+		ok, err := store.Delete(i, value)
+		if err != nil {
+			return err
+		}
+		if ok {
+			slog.Info("reclaimed stale index", "index", i, "machine_id", v.MachineId, "hostname", v.Hostname, "instance_id", v.InstanceId)
+		}
+	}
+	return nil
+}
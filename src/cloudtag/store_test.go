@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+// In-process IndexStore that findIndex and friends are tested with
+type memoryStore struct {
+	mu     sync.Mutex
+	values map[int]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: make(map[int]string)}
+}
+
+func (m *memoryStore) List() (values map[int]string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values = make(map[int]string, len(m.values))
+	for index, value := range m.values {
+		values[index] = value
+	}
+	return values, nil
+}
+
+func (m *memoryStore) Get(index int) (value string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[index], nil
+}
+
+func (m *memoryStore) CreateIfAbsent(index int, value string) (ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, taken := m.values[index]; taken {
+		return false, nil
+	}
+	m.values[index] = value
+	return true, nil
+}
+
+// Slots never expire, so there is nothing to extend
+func (m *memoryStore) Refresh(index int, value string) error {
+	return nil
+}
+
+func (m *memoryStore) Delete(index int, prevValue string) (ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if value, taken := m.values[index]; !taken || value != prevValue {
+		return false, nil
+	}
+	delete(m.values, index)
+	return true, nil
+}
+
+// Fresh memory store holding the values by index
+func useStore(values map[int]string) {
+	m := newMemoryStore()
+	for index, value := range values {
+		m.values[index] = value
+	}
+	store = m
+	indexStart, maxIndex, indexWait = 1, 100, 0
+	dryRun = false
+}
+
+func slotValue(v EtcdValue) string {
+	bin, _ := json.Marshal(&v)
+	return string(bin)
+}
+
+func TestFindIndex(t *testing.T) {
+	useStore(map[int]string{1: "a", 3: slotValue(EtcdValue{MachineId: "c"})})
+	for _, c := range []struct {
+		mid   string
+		index int
+	}{{"c", 3}, {"b", 2}, {"d", 4}, {"b", 2}, {"a", 1}} {
+		index, err := findIndex(c.mid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != c.index {
+			t.Errorf("%s: expected index %d, got %d", c.mid, c.index, index)
+		}
+	}
+	if owner, _ := get(4); owner != "d" {
+		t.Errorf("expected slot 4 to be held by d, got %q", owner)
+	}
+}
+
+func TestFindIndexSlotsBusy(t *testing.T) {
+	useStore(map[int]string{1: "a", 2: "b"})
+	maxIndex = 3
+	index, err := findIndex("c")
+	if !errors.Is(err, errSlotsBusy) {
+		t.Errorf("expected %v, got index %d, error %v", errSlotsBusy, index, err)
+	}
+	if index, err = findIndex("b"); err != nil || index != 2 {
+		t.Errorf("expected our slot 2 with all slots busy, got index %d, error %v", index, err)
+	}
+}
+
+func TestRemoveChecksOwner(t *testing.T) {
+	useStore(map[int]string{1: "a"})
+	ok, err := remove("b", 1)
+	if err != nil || ok {
+		t.Errorf("expected slot of a to stay, got ok=%v, error %v", ok, err)
+	}
+	if ok, err = remove("a", 1); err != nil || !ok {
+		t.Errorf("expected slot of a to be removed, got ok=%v, error %v", ok, err)
+	}
+	if owner, _ := get(1); owner != "" {
+		t.Errorf("expected slot 1 to be free, got %q", owner)
+	}
+}
+
+func TestReclaim(t *testing.T) {
+	defer func(id string) { instanceId = id }(instanceId)
+	hostname, _ := os.Hostname()
+	if hostname == "" || hostname == "localhost" {
+		t.Skip("hostname is not usable for matching:", hostname)
+	}
+	for _, c := range []struct {
+		name     string
+		instance string
+		slot     EtcdValue
+		stale    bool
+	}{
+		{"same instance", "i-1", EtcdValue{MachineId: "old", InstanceId: "i-1"}, true},
+		{"same instance, other hostname", "i-1", EtcdValue{MachineId: "old", InstanceId: "i-1", Hostname: "other"}, true},
+		// default EC2 hostnames repeat across VPCs, the instance id decides
+		{"same hostname, other instance", "i-1", EtcdValue{MachineId: "old", InstanceId: "i-2", Hostname: hostname}, false},
+		{"same hostname, no instance in slot", "i-1", EtcdValue{MachineId: "old", Hostname: hostname}, true},
+		{"same hostname, our instance unknown", "", EtcdValue{MachineId: "old", InstanceId: "i-2", Hostname: hostname}, false},
+		{"other hostname", "", EtcdValue{MachineId: "old", Hostname: "other"}, false},
+		{"nothing to match", "i-1", EtcdValue{MachineId: "old"}, false},
+	} {
+		instanceId = c.instance
+		useStore(map[int]string{1: slotValue(EtcdValue{MachineId: "new", InstanceId: c.instance, Hostname: hostname}), 2: slotValue(c.slot)})
+		if err := reclaim("new", 1); err != nil {
+			t.Fatal(err)
+		}
+		owner, _ := get(2)
+		if stale := owner == ""; stale != c.stale {
+			t.Errorf("%s: expected stale %v, slot 2 is held by %q", c.name, c.stale, owner)
+		}
+		if owner, _ = get(1); owner != "new" {
+			t.Errorf("%s: our slot must stay, got %q", c.name, owner)
+		}
+	}
+}
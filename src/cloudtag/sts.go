@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/mitchellh/goamz/aws"
+	"net/url"
+	"time"
+)
+
+const stsEndpoint = "https://sts.amazonaws.com/"
+
+type StsCredentials struct {
+	AccessKeyId     string    `xml:"AssumeRoleResult>Credentials>AccessKeyId"`
+	SecretAccessKey string    `xml:"AssumeRoleResult>Credentials>SecretAccessKey"`
+	SessionToken    string    `xml:"AssumeRoleResult>Credentials>SessionToken"`
+	Expiration      time.Time `xml:"AssumeRoleResult>Credentials>Expiration"`
+}
+
+// Temporary credentials of the role, obtained with the instance credentials
+func assumeRole(auth aws.Auth, roleArn string) (assumed aws.Auth, expires time.Time, err error) {
+	params := url.Values{}
+	params.Set("Action", "AssumeRole")
+	params.Set("Version", "2011-06-15")
+	params.Set("RoleArn", roleArn)
+	params.Set("RoleSessionName", "cloudtag")
+	if externalId != "" {
+		params.Set("ExternalId", externalId)
+	}
+	endpoint := stsEndpoint
+	if awsEndpoint != "" {
+		endpoint = awsEndpoint + "/"
+	}
+	var bin []byte
+	err = awsRetry(func() (err error) {
+		bin, err = awsCall(auth, aws.Regions["us-east-1"], "sts", "POST", endpoint, "application/x-www-form-urlencoded", params.Encode())
+		return
+	})
+	if err != nil {
+		return
+	}
+	var creds StsCredentials
+	err = xml.Unmarshal(bin, &creds)
+	if err != nil {
+		return
+	}
+	return aws.Auth{AccessKey: creds.AccessKeyId, SecretKey: creds.SecretAccessKey, Token: creds.SessionToken}, creds.Expiration, nil
+}
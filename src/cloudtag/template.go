@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var placeholder = regexp.MustCompile(`\{[.\w-]+\}`)
+
+// {name} placeholders are turned into text/template actions, unknown ones are rejected,
+// extra are known placeholders besides templateValues
+func parseNameTemplate(name string, text string, extra ...string) (*template.Template, error) {
+	known := templateValues(&Machine{})
+	for _, key := range extra {
+		known[key] = ""
+	}
+	var err error
+	converted := placeholder.ReplaceAllStringFunc(text, func(p string) string {
+		key := p[1 : len(p)-1]
+		if _, ok := known[key]; !ok && err == nil {
+			err = errors.New(fmt.Sprintf("Unknown placeholder %s in %s `%s`", p, name, text))
+		}
+		return fmt.Sprintf("{{index . %q}}", key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Option("missingkey=error").Parse(converted)
+}
+
+func templateValues(m *Machine) map[string]string {
+	var stackDash, dotStack string
+	if stackName != "" {
+		stackDash = stackName + "-"
+		dotStack = "." + stackName
+	}
+	return map[string]string{
+		"stack":    stackName,
+		"stack-":   stackDash,
+		".stack":   dotStack,
+		"prefix":   tagPrefix,
+		"index":    formatIndex(m.Index),
+		"az":       m.Zone,
+		"region":   m.Region,
+		"instance": m.Instance,
+	}
+}
+
+func renderName(t *template.Template, m *Machine) (string, error) {
+	return render(t, templateValues(m))
+}
+
+func render(t *template.Template, values map[string]string) (string, error) {
+	var value strings.Builder
+	err := t.Execute(&value, values)
+	if err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
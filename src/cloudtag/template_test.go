@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"text/template"
+)
+
+func TestRenderReturnsError(t *testing.T) {
+	tmpl := template.Must(template.New("tag-template").Option("missingkey=error").Parse("{{.missing}}"))
+	if value, err := render(tmpl, map[string]string{}); err == nil {
+		t.Errorf("expected error on missing key, got %q", value)
+	}
+	tmpl, err := parseNameTemplate("tag-template", "{stack-}{prefix}{index}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stack, prefix string, width int) { stackName, tagPrefix, indexWidth = stack, prefix, width }(stackName, tagPrefix, indexWidth)
+	stackName, tagPrefix, indexWidth = "prod", "web-", 0
+	if value, err := renderName(tmpl, &Machine{Index: 7}); err != nil || value != "prod-web-7" {
+		t.Errorf("expected prod-web-7, got %q, error %v", value, err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Fills options not given on the command line or in -config from the `cloudtag:` block of the user-data,
+// or from the whole user-data if it is a plain config; scripts and cloud-config without the block are skipped
+func loadUserData() error {
+	data, err := userData()
+	if err != nil || data == "" {
+		return err
+	}
+	var block []string
+	inBlock := false
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimRight(line, " \t\r") == "cloudtag:" {
+			inBlock = true
+			continue
+		}
+		if inBlock {
+			if line != "" && line[0] != ' ' && line[0] != '\t' {
+				break
+			}
+			block = append(block, line)
+		}
+	}
+	if inBlock {
+		data = strings.Join(block, "\n")
+	} else if strings.HasPrefix(data, "#!") || strings.HasPrefix(data, "#cloud-config") || strings.HasPrefix(data, "Content-Type:") {
+		slog.Debug("user-data has no cloudtag block, skipping")
+		return nil
+	}
+	return applyConfig("user-data", strings.NewReader(data))
+}
+
+// Instance user-data, empty if none was given; retried like the rest of the metadata, as it is read first at boot
+func userData() (string, error) {
+	return metadataRetry("user-data", userDataOnce)
+}
+
+func userDataOnce(what string) (value string, retry bool, err error) {
+	base, err := url.Parse(strings.TrimSuffix(metadataUrl, "/") + "/")
+	if err != nil {
+		return "", false, err
+	}
+	token, retry, err := imdsToken()
+	if err != nil {
+		return "", retry, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", base.ResolveReference(&url.URL{Path: "../" + what}).String(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	res, err := metadataClient.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	bin, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", true, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		slog.Debug("no user-data")
+		return "", false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", res.StatusCode >= 500, errors.New(fmt.Sprintf("Cannot read instance user-data, got %v", res.Status))
+	}
+	return string(bin), false, nil
+}